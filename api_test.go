@@ -0,0 +1,1575 @@
+package main
+
+import "os"
+import "io"
+import "log"
+import "time"
+import "bytes"
+import "bufio"
+import "errors"
+import "context"
+import "testing"
+import "strings"
+import "strconv"
+import "net/http"
+import "net/http/httptest"
+import "encoding/json"
+import "github.com/google/uuid"
+
+type apiResponse struct {
+    Status string `json:"status"`
+    Content json.RawMessage `json:"content"`
+}
+
+// Single step of a route table, steps run in order and share the
+// harness so later steps can use ids captured by earlier ones.
+type apiCase struct {
+    name string
+    method string
+    path string
+    anonymous bool
+    body func() interface{}
+    status int
+    envelope string
+    check func(*testing.T, json.RawMessage)
+}
+
+// Placeholders like {store} in case paths are replaced with the ids
+// captured by earlier cases.
+type apiHarness struct {
+    *httptest.Server
+    token string
+    ids map[string]*int
+}
+
+// Users outlive a single test run when tests are repeated, usernames
+// get a letter suffix since digits are not allowed.
+var apiUsers int
+
+// Passwords of test users have to pass the default password policy.
+func testPassword(username string) string {
+    return "Violet lanterns " + username + " 4 ever"
+}
+
+func uniqueUsername(name string) string {
+    apiUsers++
+    for n := apiUsers; n > 0; n /= 26 {
+        name += string(rune('a' + n % 26))
+    }
+    return name
+}
+
+func TestMain(m *testing.M) {
+    log.SetOutput(io.Discard)
+
+    var database = &VincaDatabase{}
+    if err := database.OpenWith(DriverMemory, ""); err != nil {
+        panic(err)
+    }
+    if err := database.MigrateUp(); err != nil {
+        panic(err)
+    }
+    vincaRepository = database
+    vincaSessions = NewMemorySessions(time.Hour, 24 * time.Hour)
+
+    code := m.Run()
+    vincaRepository.Close()
+    os.Exit(code)
+}
+
+// Failed logins of earlier tests share the loopback address, every
+// harness starts with a fresh login guard.
+func newApiHarness(t *testing.T) *apiHarness {
+    vincaLoginGuard = NewLoginGuard(LockoutConfig{})
+
+    ts := httptest.NewServer(vincaMux)
+    t.Cleanup(ts.Close)
+    return &apiHarness{Server: ts}
+}
+
+func (h *apiHarness) request(t *testing.T, ctx context.Context, method, path string, body interface{}, anonymous bool) *http.Response {
+    t.Helper()
+
+    var reader io.Reader = http.NoBody
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            t.Fatal("unable to encode request:", err)
+        }
+        reader = bytes.NewReader(data)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, h.URL + path, reader)
+    if err != nil {
+        t.Fatal("unable to create request:", err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if h.token != "" && !anonymous {
+        req.Header.Set("Vinca-Authentication", h.token)
+    }
+
+    resp, err := h.Client().Do(req)
+    if err != nil {
+        t.Fatal("request failed:", err)
+    }
+    return resp
+}
+
+func (h *apiHarness) call(t *testing.T, method, path string, body interface{}, anonymous bool) (int, apiResponse) {
+    t.Helper()
+
+    resp := h.request(t, context.Background(), method, path, body, anonymous)
+    defer resp.Body.Close()
+
+    var envelope = apiResponse{}
+    if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+        t.Fatalf("%s %s: unable to decode response envelope: %v", method, path, err)
+    }
+    return resp.StatusCode, envelope
+}
+
+func (h *apiHarness) run(t *testing.T, cases []apiCase) {
+    t.Helper()
+
+    for _, tc := range cases {
+        var body interface{}
+        if tc.body != nil {
+            body = tc.body()
+        }
+
+        path := tc.path
+        for name, id := range h.ids {
+            path = strings.ReplaceAll(path, "{" + name + "}", strconv.Itoa(*id))
+        }
+
+        status, envelope := h.call(t, tc.method, path, body, tc.anonymous)
+        if status != tc.status || envelope.Status != tc.envelope {
+            t.Fatalf("%s: expected %d %q, got %d %q (%s)", tc.name, tc.status, tc.envelope,
+                    status, envelope.Status, envelope.Content)
+        }
+
+        if tc.check != nil {
+            tc.check(t, envelope.Content)
+        }
+    }
+}
+
+// Registers a new user and stores its session token in the harness,
+// returns the email of the registered user.
+func (h *apiHarness) login(t *testing.T, name string) string {
+    t.Helper()
+
+    username := uniqueUsername(name)
+    var params = UserParam{Username: username, Email: username + "@example.com", Password: testPassword(username)}
+    if status, envelope := h.call(t, "POST", "/api/v1/auth/register", params, true); status != http.StatusOK {
+        t.Fatalf("unable to register %s: %d %s", username, status, envelope.Status)
+    }
+
+    status, envelope := h.call(t, "POST", "/api/v1/auth/login", params, true)
+    if status != http.StatusOK {
+        t.Fatalf("unable to login %s: %d %s", username, status, envelope.Status)
+    }
+
+    var login = LoginResponse{}
+    decodeContent(t, envelope.Content, &login)
+    h.token = login.Uuid
+
+    return params.Email
+}
+
+func decodeContent(t *testing.T, content json.RawMessage, v interface{}) {
+    t.Helper()
+
+    if err := json.Unmarshal(content, v); err != nil {
+        t.Fatalf("unable to decode content %s: %v", content, err)
+    }
+}
+
+func jsonBody(v interface{}) func() interface{} {
+    return func() interface{} { return v }
+}
+
+// Checks that a validation error rejected exactly the given fields.
+func expectFields(fields ...string) func(*testing.T, json.RawMessage) {
+    return func(t *testing.T, content json.RawMessage) {
+        var resp = ValidationContent{}
+        decodeContent(t, content, &resp)
+
+        var rejected []string
+        for _, field := range resp.Fields {
+            rejected = append(rejected, field.Field)
+        }
+        if strings.Join(rejected, ",") != strings.Join(fields, ",") {
+            t.Errorf("expected rejected fields %v, got %s", fields, content)
+        }
+    }
+}
+
+func TestAuthRoutes(t *testing.T) {
+    h := newApiHarness(t)
+
+    username := uniqueUsername("alice")
+    var account = UserParam{Username: username, Email: username + "@example.com", Password: "Correct horse 7 stapled"}
+    var firstToken string
+
+    h.run(t, []apiCase{
+        {name: "register invalid", method: "POST", path: "/api/v1/auth/register",
+            body: jsonBody(UserParam{Username: "al1ce", Email: "alice", Password: "x"}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("username", "email", "password", "password")},
+        {name: "register guessable password", method: "POST", path: "/api/v1/auth/register",
+            body: jsonBody(UserParam{Username: username, Email: account.Email, Password: username + "12345678"}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("password")},
+        {name: "register malformed", method: "POST", path: "/api/v1/auth/register",
+            body: jsonBody("not an object"),
+            status: http.StatusBadRequest, envelope: "sys_invalid_params"},
+        {name: "register", method: "POST", path: "/api/v1/auth/register",
+            body: jsonBody(account), status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var usr = User{}
+                decodeContent(t, content, &usr)
+                if usr.Email != account.Email || usr.Username != account.Username {
+                    t.Errorf("unexpected registered user: %s", content)
+                }
+            }},
+        {name: "register duplicate", method: "POST", path: "/api/v1/auth/register",
+            body: jsonBody(account), status: http.StatusConflict, envelope: "sys_email_exists"},
+        {name: "login wrong password", method: "POST", path: "/api/v1/auth/login",
+            body: jsonBody(UserParam{Email: account.Email, Password: "wrong"}),
+            status: http.StatusUnauthorized, envelope: "user_login_invalid"},
+        {name: "login unknown user", method: "POST", path: "/api/v1/auth/login",
+            body: jsonBody(UserParam{Email: "nobody@example.com", Password: "wrong"}),
+            status: http.StatusUnauthorized, envelope: "user_login_invalid"},
+        {name: "login", method: "POST", path: "/api/v1/auth/login",
+            body: jsonBody(account), status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var login = LoginResponse{}
+                decodeContent(t, content, &login)
+                if login.Uuid == "" || login.Pending != "" {
+                    t.Fatalf("expected session uuid, got %s", content)
+                }
+                h.token, firstToken = login.Uuid, login.Uuid
+            }},
+        {name: "session anonymous", method: "GET", path: "/api/v1/auth/session", anonymous: true,
+            status: http.StatusUnauthorized, envelope: "user_session_invalid"},
+        {name: "session", method: "GET", path: "/api/v1/auth/session",
+            status: http.StatusOK, envelope: "success"},
+        {name: "second login", method: "POST", path: "/api/v1/auth/login",
+            body: jsonBody(account), status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var login = LoginResponse{}
+                decodeContent(t, content, &login)
+                h.token = login.Uuid
+            }},
+        {name: "sessions", method: "GET", path: "/api/v1/auth/sessions",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var sessions []SessionInfo
+                decodeContent(t, content, &sessions)
+                if len(sessions) != 2 {
+                    t.Fatalf("expected 2 sessions, got %s", content)
+                }
+            }},
+        {name: "revoke unknown session", method: "POST", path: "/api/v1/auth/sessions/revoke",
+            body: jsonBody(SessionRevokeRequest{Id: "0000"}),
+            status: http.StatusNotFound, envelope: "sys_not_found"},
+        {name: "revoke first session", method: "POST", path: "/api/v1/auth/sessions/revoke",
+            body: func() interface{} {
+                suid, _ := uuid.Parse(firstToken)
+                return SessionRevokeRequest{Id: SessionPublicId(suid)}
+            },
+            status: http.StatusOK, envelope: "success"},
+        {name: "2fa enroll", method: "POST", path: "/api/v1/auth/2fa/enroll",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var enroll = TwoFactorEnrollResponse{}
+                decodeContent(t, content, &enroll)
+                if enroll.Secret == "" || !strings.HasPrefix(enroll.Uri, "otpauth://totp/") {
+                    t.Errorf("unexpected enrollment: %s", content)
+                }
+            }},
+        {name: "2fa verify invalid", method: "POST", path: "/api/v1/auth/2fa/verify",
+            body: jsonBody(TwoFactorRequest{Code: "000000x"}),
+            status: http.StatusUnauthorized, envelope: "user_2fa_invalid"},
+        {name: "2fa disable not enabled", method: "POST", path: "/api/v1/auth/2fa/disable",
+            body: jsonBody(TwoFactorRequest{Code: "000000", Confirmation: account.Password}),
+            status: http.StatusBadRequest, envelope: "user_2fa_disabled"},
+        {name: "login 2fa invalid pending", method: "POST", path: "/api/v1/auth/login/2fa",
+            body: jsonBody(LoginTwoFactorRequest{Pending: "unknown", Code: "000000"}),
+            status: http.StatusUnauthorized, envelope: "user_login_invalid"},
+        {name: "reset", method: "POST", path: "/api/v1/auth/reset", anonymous: true,
+            body: jsonBody(ResetRequest{Email: account.Email}),
+            status: http.StatusOK, envelope: "success"},
+        {name: "reset unknown email", method: "POST", path: "/api/v1/auth/reset", anonymous: true,
+            body: jsonBody(ResetRequest{Email: "nobody@example.com"}),
+            status: http.StatusOK, envelope: "success"},
+        {name: "reset confirm invalid", method: "POST", path: "/api/v1/auth/reset/confirm", anonymous: true,
+            body: jsonBody(ResetConfirmRequest{Token: "invalid", Password: "Lanterns glow at 9 dusk"}),
+            status: http.StatusBadRequest, envelope: "user_reset_invalid"},
+        {name: "reset confirm missing", method: "POST", path: "/api/v1/auth/reset/confirm", anonymous: true,
+            body: jsonBody(ResetConfirmRequest{}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("token", "password")},
+        {name: "logout", method: "POST", path: "/api/v1/auth/logout",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var logout = LogoutResponse{}
+                decodeContent(t, content, &logout)
+                if logout.Removed != 1 {
+                    t.Errorf("expected 1 removed session, got %s", content)
+                }
+            }},
+        {name: "session after logout", method: "GET", path: "/api/v1/auth/session",
+            status: http.StatusUnauthorized, envelope: "user_session_invalid"},
+        {name: "relogin", method: "POST", path: "/api/v1/auth/login",
+            body: jsonBody(account), status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var login = LoginResponse{}
+                decodeContent(t, content, &login)
+                h.token = login.Uuid
+            }},
+        {name: "logout all", method: "POST", path: "/api/v1/auth/logout/all",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var logout = LogoutResponse{}
+                decodeContent(t, content, &logout)
+                if logout.Removed != 1 {
+                    t.Errorf("expected 1 removed session, got %s", content)
+                }
+            }},
+        {name: "session after logout all", method: "GET", path: "/api/v1/auth/session",
+            status: http.StatusUnauthorized, envelope: "user_session_invalid"},
+    })
+}
+
+func TestHomeRoutes(t *testing.T) {
+    h := newApiHarness(t)
+    email := h.login(t, "bob")
+
+    var container = Container{}
+    var category = Category{}
+    var store = Store{}
+
+    h.run(t, []apiCase{
+        {name: "home without container", method: "GET", path: "/api/v1/home",
+            status: http.StatusOK, envelope: "success"},
+        {name: "container create", method: "POST", path: "/api/v1/home/container",
+            body: jsonBody(ContainerRequest{Name: "Personal", Certificate: []byte("cert"), Encrypted: []byte("key")}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = ContainerResponse{}
+                decodeContent(t, content, &resp)
+                if resp.Id < 1 || resp.Name != "Personal" {
+                    t.Fatalf("unexpected container: %s", content)
+                }
+                container = resp.Container
+            }},
+        {name: "container get", method: "GET", path: "/api/v1/home/container",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = ContainerResponse{}
+                decodeContent(t, content, &resp)
+                if resp.Id != container.Id || string(resp.Encrypted) != "key" {
+                    t.Errorf("unexpected default container: %s", content)
+                }
+            }},
+        {name: "container rename", method: "PATCH", path: "/api/v1/home/container",
+            body: func() interface{} { return Container{Id: container.Id, Name: "Work"} },
+            status: http.StatusOK, envelope: "success"},
+        {name: "container rename empty", method: "PATCH", path: "/api/v1/home/container",
+            body: func() interface{} { return Container{Id: container.Id} },
+            status: http.StatusBadRequest, envelope: "sys_invalid_params"},
+        {name: "containers", method: "GET", path: "/api/v1/home/containers",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = ContainersResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Containers) != 1 || resp.Containers[0].Name != "Work" {
+                    t.Errorf("unexpected containers: %s", content)
+                }
+            }},
+        {name: "category create", method: "POST", path: "/api/v1/home/category",
+            body: jsonBody(CategoryParams{Name: "Social", Icon: 2}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = CategoryResponse{}
+                decodeContent(t, content, &resp)
+                if resp.Created == nil || resp.Created.Id < 1 || len(resp.Categories) != 1 {
+                    t.Fatalf("unexpected category response: %s", content)
+                }
+                category = *resp.Created
+            }},
+        {name: "categories", method: "GET", path: "/api/v1/home/categories",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var categories []Category
+                decodeContent(t, content, &categories)
+                if len(categories) != 1 || categories[0].Name != "Social" {
+                    t.Errorf("unexpected categories: %s", content)
+                }
+            }},
+        {name: "category update without version", method: "PATCH", path: "/api/v1/home/category",
+            body: func() interface{} { return Category{Id: category.Id, CategoryParams: CategoryParams{Name: "Friends"}} },
+            status: http.StatusPreconditionRequired, envelope: "sys_version_required"},
+        {name: "category update", method: "PATCH", path: "/api/v1/home/category",
+            body: func() interface{} {
+                return Category{Id: category.Id, Version: category.Version, CategoryParams: CategoryParams{Name: "Friends"}}
+            },
+            status: http.StatusOK, envelope: "success"},
+        {name: "category update stale", method: "PATCH", path: "/api/v1/home/category",
+            body: func() interface{} {
+                return Category{Id: category.Id, Version: category.Version, CategoryParams: CategoryParams{Name: "Stale"}}
+            },
+            status: http.StatusConflict, envelope: "sys_stale_write",
+            check: func(t *testing.T, content json.RawMessage) {
+                var current = Category{}
+                decodeContent(t, content, &current)
+                if current.Name != "Friends" || current.Version != category.Version + 1 {
+                    t.Errorf("unexpected server copy: %s", content)
+                }
+            }},
+        {name: "store create", method: "POST", path: "/api/v1/home/store/create",
+            body: func() interface{} {
+                return StoreParam{Name: "GitHub", Category: category.Id, Content: []byte("sealed")}
+            },
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                decodeContent(t, content, &store)
+                if store.Id < 1 || store.Container != container.Id {
+                    t.Fatalf("unexpected store: %s", content)
+                }
+            }},
+        {name: "stores", method: "POST", path: "/api/v1/home/stores",
+            body: func() interface{} { return StoresRequest{Category: category.Id} },
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = StoreResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Stores) != 1 || resp.Stores[0].Id != store.Id {
+                    t.Errorf("unexpected stores: %s", content)
+                }
+            }},
+        {name: "store content", method: "POST", path: "/api/v1/home/store",
+            body: func() interface{} { return StoreContentRequest{StoreId: store.Id} },
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = Store{}
+                decodeContent(t, content, &resp)
+                if string(resp.Content) != "sealed" || resp.Version != 1 {
+                    t.Errorf("unexpected store content: %s", content)
+                }
+            }},
+        {name: "store update", method: "PATCH", path: "/api/v1/home/store",
+            body: func() interface{} {
+                var update = store
+                update.Name = "GitHub Enterprise"
+                update.Content = []byte("resealed")
+                return update
+            },
+            status: http.StatusOK, envelope: "success"},
+        {name: "store update stale", method: "PATCH", path: "/api/v1/home/store",
+            body: func() interface{} { return store },
+            status: http.StatusConflict, envelope: "sys_stale_write"},
+        {name: "store search", method: "POST", path: "/api/v1/home/store/search",
+            body: jsonBody(StoreQuery{Query: "Enterprise"}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = StoreResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Stores) != 1 {
+                    t.Errorf("expected one search result, got %s", content)
+                }
+            }},
+        {name: "store search miss", method: "POST", path: "/api/v1/home/store/search",
+            body: jsonBody(StoreQuery{Query: "gitlab"}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = StoreResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Stores) != 0 {
+                    t.Errorf("expected no search results, got %s", content)
+                }
+            }},
+        {name: "store revisions", method: "POST", path: "/api/v1/home/store/revisions",
+            body: func() interface{} { return RevisionRequest{StoreId: store.Id} },
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = RevisionsResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Revisions) != 1 || resp.Revisions[0].Name != "GitHub" {
+                    t.Fatalf("unexpected revisions: %s", content)
+                }
+                store.Version = resp.Revisions[0].Id
+            }},
+        {name: "store revision restore", method: "POST", path: "/api/v1/home/store/revisions/restore",
+            body: func() interface{} { return RevisionRequest{StoreId: store.Id, Revision: store.Version} },
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                decodeContent(t, content, &store)
+                if store.Name != "GitHub" || string(store.Content) != "sealed" {
+                    t.Errorf("unexpected restored store: %s", content)
+                }
+            }},
+        {name: "home", method: "GET", path: "/api/v1/home",
+            status: http.StatusOK, envelope: "success"},
+        {name: "preferences wrong confirmation", method: "POST", path: "/api/v1/home/preferences",
+            body: jsonBody(UserUpdateRequest{Confirmation: "wrong", UserParam: UserParam{Email: email}}),
+            status: http.StatusUnauthorized, envelope: "usr_invalid_pass"},
+        {name: "preferences weak password", method: "POST", path: "/api/v1/home/preferences",
+            body: jsonBody(UserUpdateRequest{Confirmation: "wrong", UserParam: UserParam{Email: email, Password: "qwertyuiop"}}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("password", "password")},
+        {name: "preferences", method: "POST", path: "/api/v1/home/preferences",
+            body: jsonBody(UserUpdateRequest{Confirmation: testPassword(strings.Split(email, "@")[0]), UserParam: UserParam{Email: email, DarkMode: true}}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var usr = User{}
+                decodeContent(t, content, &usr)
+                if !usr.DarkMode {
+                    t.Errorf("preferences not applied: %s", content)
+                }
+            }},
+        {name: "export", method: "GET", path: "/api/v1/home/export",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var export = VaultExport{}
+                decodeContent(t, content, &export)
+                if len(export.Stores) != 1 || len(export.Categories) != 1 {
+                    t.Errorf("unexpected export: %s", content)
+                }
+            }},
+        {name: "import parse", method: "POST", path: "/api/v1/home/import/parse",
+            body: jsonBody(ImportParseRequest{Format: ImportCSV, Data: "name,url,username,password\nGitHub,https://github.com,bob,pw\nMail,https://mail.example.com,bob,pw\n"}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var result = ImportResult{}
+                decodeContent(t, content, &result)
+                if len(result.Entries) != 2 || !result.Entries[0].Duplicate || result.Entries[1].Duplicate {
+                    t.Errorf("unexpected import result: %s", content)
+                }
+            }},
+        {name: "import parse unsupported", method: "POST", path: "/api/v1/home/import/parse",
+            body: jsonBody(ImportParseRequest{Format: "keychain"}),
+            status: http.StatusBadRequest, envelope: "import_format_unsupported"},
+        {name: "import commit", method: "POST", path: "/api/v1/home/import/commit",
+            body: func() interface{} {
+                return ImportCommitRequest{Container: container.Id, Entries: []ImportStore{
+                    {Row: 3, Category: "Mail", Name: "Mail", Content: []byte("sealed")},
+                }}
+            },
+            status: http.StatusOK, envelope: "success"},
+        {name: "store delete", method: "POST", path: "/api/v1/home/store/delete",
+            body: func() interface{} { return Store{Id: store.Id} },
+            status: http.StatusOK, envelope: "success"},
+        {name: "trash", method: "GET", path: "/api/v1/home/trash",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = TrashResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Stores) != 1 {
+                    t.Errorf("expected one trashed store, got %s", content)
+                }
+            }},
+        {name: "trash restore", method: "POST", path: "/api/v1/home/trash/restore",
+            body: func() interface{} { return Store{Id: store.Id} },
+            status: http.StatusOK, envelope: "success"},
+        {name: "store delete again", method: "POST", path: "/api/v1/home/store/delete",
+            body: func() interface{} { return Store{Id: store.Id} },
+            status: http.StatusOK, envelope: "success"},
+        {name: "trash purge", method: "POST", path: "/api/v1/home/trash/purge",
+            body: func() interface{} { return Store{Id: store.Id} },
+            status: http.StatusOK, envelope: "success"},
+        {name: "trash empty", method: "POST", path: "/api/v1/home/trash/empty",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = TrashEmptyResponse{}
+                decodeContent(t, content, &resp)
+                if resp.Purged != 0 {
+                    t.Errorf("expected an empty trash, got %s", content)
+                }
+            }},
+        {name: "category delete", method: "POST", path: "/api/v1/home/category/delete",
+            body: func() interface{} { return CategoryDestroyRequest{Id: category.Id} },
+            status: http.StatusOK, envelope: "success"},
+        {name: "container rotate incomplete", method: "POST", path: "/api/v1/home/container/rotate",
+            body: func() interface{} {
+                return ContainerRotateRequest{Id: container.Id, Certificate: []byte("cert2"), Encrypted: []byte("key2")}
+            },
+            status: http.StatusConflict, envelope: ErrRotationIncomplete.Error()},
+        {name: "container delete", method: "POST", path: "/api/v1/home/container/delete",
+            body: func() interface{} { return Container{Id: container.Id} },
+            status: http.StatusOK, envelope: "success"},
+    })
+}
+
+func TestMemberRoutes(t *testing.T) {
+    owner, member, keyless := newApiHarness(t), newApiHarness(t), newApiHarness(t)
+    owner.login(t, "carol")
+    email := member.login(t, "dave")
+    keylessEmail := keyless.login(t, "erin")
+
+    var container = Container{}
+    for _, h := range []*apiHarness{owner, member} {
+        _, envelope := h.call(t, "POST", "/api/v1/home/container",
+                ContainerRequest{Certificate: []byte("cert"), Encrypted: []byte("key")}, false)
+        var resp = ContainerResponse{}
+        decodeContent(t, envelope.Content, &resp)
+        if h == owner {
+            container = resp.Container
+        }
+    }
+
+    owner.run(t, []apiCase{
+        {name: "member key", method: "POST", path: "/api/v1/home/container/members/key",
+            body: func() interface{} { return MemberRequest{Container: container.Id, Email: email} },
+            status: http.StatusOK, envelope: "success"},
+        {name: "member key unknown email", method: "POST", path: "/api/v1/home/container/members/key",
+            body: func() interface{} { return MemberRequest{Container: container.Id, Email: "nobody@example.com"} },
+            status: http.StatusBadRequest, envelope: "container_member_invalid"},
+        {name: "member key without container", method: "POST", path: "/api/v1/home/container/members/key",
+            body: func() interface{} { return MemberRequest{Container: container.Id, Email: keylessEmail} },
+            status: http.StatusBadRequest, envelope: "container_member_invalid"},
+        {name: "member key without owned container", method: "POST", path: "/api/v1/home/container/members/key",
+            body: jsonBody(MemberRequest{Email: email}),
+            status: http.StatusNotFound, envelope: "sys_not_found"},
+        {name: "member invite invalid role", method: "POST", path: "/api/v1/home/container/members/invite",
+            body: func() interface{} {
+                return MemberRequest{Container: container.Id, Email: email, Role: "admin", Encrypted: []byte("wrapped")}
+            },
+            status: http.StatusBadRequest, envelope: "sys_invalid_params"},
+        {name: "member invite", method: "POST", path: "/api/v1/home/container/members/invite",
+            body: func() interface{} {
+                return MemberRequest{Container: container.Id, Email: email, Role: MemberRead, Encrypted: []byte("wrapped")}
+            },
+            status: http.StatusOK, envelope: "success"},
+        {name: "members", method: "POST", path: "/api/v1/home/container/members",
+            body: func() interface{} { return MemberRequest{Container: container.Id} },
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = MembersResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Members) != 1 || resp.Members[0].Role != MemberRead {
+                    t.Errorf("unexpected members: %s", content)
+                }
+            }},
+    })
+
+    member.ids = map[string]*int{"container": &container.Id}
+    member.run(t, []apiCase{
+        {name: "shared containers", method: "GET", path: "/api/v1/home/containers",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = ContainersResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Containers) != 2 || !resp.Containers[1].Shared {
+                    t.Errorf("unexpected containers: %s", content)
+                }
+            }},
+        {name: "shared container get", method: "GET", path: "/api/v1/containers/{container}",
+            status: http.StatusOK, envelope: "success"},
+        {name: "member key forbidden", method: "POST", path: "/api/v1/home/container/members/key",
+            body: func() interface{} { return MemberRequest{Container: container.Id, Email: keylessEmail} },
+            status: http.StatusForbidden, envelope: "sys_forbidden"},
+        {name: "member rename forbidden", method: "PATCH", path: "/api/v1/containers/{container}",
+            body: jsonBody(Container{Name: "Mine"}),
+            status: http.StatusForbidden, envelope: "sys_forbidden"},
+        {name: "unknown container", method: "GET", path: "/api/v1/containers/99999",
+            status: http.StatusNotFound, envelope: "sys_not_found"},
+        {name: "read only store create", method: "POST", path: "/api/v1/home/store/create",
+            body: func() interface{} { return StoreParam{Name: "Shared", Container: container.Id} },
+            status: ErrContainerReadOnly.status, envelope: ErrContainerReadOnly.Error()},
+    })
+
+    owner.run(t, []apiCase{
+        {name: "member remove", method: "POST", path: "/api/v1/home/container/members/remove",
+            body: func() interface{} { return MemberRequest{Container: container.Id, Email: email} },
+            status: http.StatusOK, envelope: "success"},
+    })
+}
+
+// Enrolls the logged in user into two factor authentication and returns
+// the TOTP secret.
+func (h *apiHarness) enableTwoFactor(t *testing.T) []byte {
+    t.Helper()
+
+    status, envelope := h.call(t, "POST", "/api/v1/auth/2fa/enroll", nil, false)
+    if status != http.StatusOK {
+        t.Fatalf("unable to enroll 2fa: %d %s", status, envelope.Status)
+    }
+
+    var enroll = TwoFactorEnrollResponse{}
+    decodeContent(t, envelope.Content, &enroll)
+    secret, err := totpEncoding.DecodeString(enroll.Secret)
+    if err != nil {
+        t.Fatal("unable to decode totp secret:", err)
+    }
+
+    code := TotpCode(secret, uint64(time.Now().Unix() / TotpPeriod))
+    if status, envelope = h.call(t, "POST", "/api/v1/auth/2fa/verify", TwoFactorRequest{Code: code}, false); status != http.StatusOK {
+        t.Fatalf("unable to verify 2fa: %d %s", status, envelope.Status)
+    }
+    return secret
+}
+
+// Failed codes count against the account, new pending logins must not
+// reset the counter.
+func TestTwoFactorLoginLockout(t *testing.T) {
+    h := newApiHarness(t)
+    email := h.login(t, "heidi")
+    h.enableTwoFactor(t)
+
+    var params = UserParam{Email: email, Password: testPassword(strings.Split(email, "@")[0])}
+    var locked bool
+    for i := 0; i < 2 * vincaLoginGuard.threshold && !locked; i++ {
+        status, envelope := h.call(t, "POST", "/api/v1/auth/login", params, true)
+        if status == http.StatusTooManyRequests {
+            locked = true
+            break
+        } else if status != http.StatusOK {
+            t.Fatalf("unexpected login response: %d %s", status, envelope.Status)
+        }
+
+        var login = LoginResponse{}
+        decodeContent(t, envelope.Content, &login)
+        if login.Pending == "" {
+            t.Fatalf("expected a pending login, got %s", envelope.Content)
+        }
+
+        status, envelope = h.call(t, "POST", "/api/v1/auth/login/2fa",
+                LoginTwoFactorRequest{Pending: login.Pending, Code: "abcdef"}, true)
+        switch status {
+        case http.StatusTooManyRequests:
+            locked = true
+        case http.StatusUnauthorized:
+        default:
+            t.Fatalf("unexpected 2fa response: %d %s", status, envelope.Status)
+        }
+    }
+
+    if !locked {
+        t.Fatal("guessing second factor codes never locked the account")
+    }
+
+    if status, envelope := h.call(t, "POST", "/api/v1/auth/login", params, true); status != http.StatusTooManyRequests {
+        t.Errorf("expected locked account, got %d %s", status, envelope.Status)
+    }
+}
+
+// An accepted code must not be usable a second time within its window.
+func TestTwoFactorReplay(t *testing.T) {
+    h := newApiHarness(t)
+    email := h.login(t, "ivy")
+    secret := h.enableTwoFactor(t)
+
+    var params = UserParam{Email: email, Password: testPassword(strings.Split(email, "@")[0])}
+    step := uint64(time.Now().Unix() / TotpPeriod)
+    for _, tt := range []struct{ name string; step uint64; status int }{
+        {"enrollment code", step, http.StatusUnauthorized},
+        {"next code", step + 1, http.StatusOK},
+        {"replayed code", step + 1, http.StatusUnauthorized},
+    } {
+        status, envelope := h.call(t, "POST", "/api/v1/auth/login", params, true)
+        if status != http.StatusOK {
+            t.Fatalf("%s: unexpected login response: %d %s", tt.name, status, envelope.Status)
+        }
+
+        var login = LoginResponse{}
+        decodeContent(t, envelope.Content, &login)
+        status, envelope = h.call(t, "POST", "/api/v1/auth/login/2fa",
+                LoginTwoFactorRequest{Pending: login.Pending, Code: TotpCode(secret, tt.step)}, true)
+        if status != tt.status {
+            t.Errorf("%s: expected %d, got %d %s", tt.name, tt.status, status, envelope.Status)
+        }
+    }
+}
+
+// Stores of a container the user is invited to are older than the
+// cursor, they still have to arrive with the next incremental sync.
+func TestSyncInvite(t *testing.T) {
+    owner, member := newApiHarness(t), newApiHarness(t)
+    owner.login(t, "ivan")
+    email := member.login(t, "judy")
+
+    var container = Container{}
+    for _, h := range []*apiHarness{owner, member} {
+        _, envelope := h.call(t, "POST", "/api/v1/home/container",
+                ContainerRequest{Certificate: []byte("cert"), Encrypted: []byte("key")}, false)
+        var resp = ContainerResponse{}
+        decodeContent(t, envelope.Content, &resp)
+        if h == owner {
+            container = resp.Container
+        }
+    }
+
+    var category = Category{}
+    var store = Store{}
+    owner.run(t, []apiCase{
+        {name: "category create", method: "POST", path: "/api/v1/categories",
+            body: jsonBody(CategoryParams{Name: "Shared"}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = CategoryResponse{}
+                decodeContent(t, content, &resp)
+                category = *resp.Created
+            }},
+        {name: "store create", method: "POST", path: "/api/v1/stores",
+            body: func() interface{} {
+                return StoreParam{Name: "Router", Container: container.Id, Category: category.Id, Content: []byte("sealed")}
+            },
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                decodeContent(t, content, &store)
+            }},
+    })
+
+    // Backdate the shared data so only the membership is newer than the cursor.
+    db := vincaRepository.(*VincaDatabase).db
+    if _, err := db.Exec("update stores set modified = datetime(modified, '-1 hour') where id = ?", store.Id); err != nil {
+        t.Fatal("unable to backdate store:", err)
+    }
+    if _, err := db.Exec("update categories set modified = datetime(modified, '-1 hour') where id = ?", category.Id); err != nil {
+        t.Fatal("unable to backdate category:", err)
+    }
+
+    var cursor string
+    member.run(t, []apiCase{
+        {name: "initial sync", method: "GET", path: "/api/v1/sync",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = SyncResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Stores) != 0 {
+                    t.Errorf("unexpected stores before the invite: %s", content)
+                }
+                cursor = resp.Cursor
+            }},
+    })
+
+    owner.run(t, []apiCase{
+        {name: "member invite", method: "POST", path: "/api/v1/home/container/members/invite",
+            body: func() interface{} {
+                return MemberRequest{Container: container.Id, Email: email, Role: MemberRead, Encrypted: []byte("wrapped")}
+            },
+            status: http.StatusOK, envelope: "success"},
+    })
+
+    member.run(t, []apiCase{
+        {name: "incremental sync", method: "GET", path: "/api/v1/sync?since=" + cursor,
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = SyncResponse{}
+                decodeContent(t, content, &resp)
+                if resp.Full {
+                    t.Fatalf("expected an incremental sync: %s", content)
+                }
+                if len(resp.Stores) != 1 || resp.Stores[0].Id != store.Id {
+                    t.Errorf("expected the shared store, got %s", content)
+                }
+                if len(resp.Categories) != 1 || resp.Categories[0].Id != category.Id {
+                    t.Errorf("expected the shared category, got %s", content)
+                }
+            }},
+    })
+}
+
+// Browser clients read the version from the ETag header and send it back
+// through If-Match.
+func TestStoreETag(t *testing.T) {
+    h := newApiHarness(t)
+    h.login(t, "kate")
+
+    var store = Store{}
+    h.run(t, []apiCase{
+        {name: "container create", method: "POST", path: "/api/v1/containers",
+            body: jsonBody(ContainerRequest{Certificate: []byte("cert"), Encrypted: []byte("key")}),
+            status: http.StatusOK, envelope: "success"},
+        {name: "store create", method: "POST", path: "/api/v1/stores",
+            body: jsonBody(StoreParam{Name: "GitHub", Content: []byte("sealed")}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                decodeContent(t, content, &store)
+            }},
+    })
+
+    send := func(method string, body interface{}, ifMatch string) *http.Response {
+        t.Helper()
+
+        var reader io.Reader = http.NoBody
+        if body != nil {
+            data, _ := json.Marshal(body)
+            reader = bytes.NewReader(data)
+        }
+        req, _ := http.NewRequest(method, h.URL + "/api/v1/stores/" + strconv.Itoa(store.Id), reader)
+        req.Header.Set("Vinca-Authentication", h.token)
+        req.Header.Set("Origin", "https://vinca.example")
+        if ifMatch != "" {
+            req.Header.Set("If-Match", ifMatch)
+        }
+
+        resp, err := h.Client().Do(req)
+        if err != nil {
+            t.Fatal("request failed:", err)
+        }
+        resp.Body.Close()
+        return resp
+    }
+
+    resp := send("GET", nil, "")
+    if etag := resp.Header.Get("ETag"); etag != `"1"` {
+        t.Fatalf("expected ETag \"1\", got %q", etag)
+    }
+    if expose := resp.Header.Get("Access-Control-Expose-Headers"); !strings.Contains(expose, "ETag") {
+        t.Errorf("ETag is not exposed to browsers: %q", expose)
+    }
+
+    resp = send("OPTIONS", nil, "")
+    if allow := resp.Header.Get("Access-Control-Allow-Headers"); !strings.Contains(allow, "If-Match") {
+        t.Errorf("If-Match is not allowed for browsers: %q", allow)
+    }
+
+    var update = StoreParam{Name: "GitLab"}
+    if resp = send("PATCH", update, `W/"1"`); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("weak If-Match: expected 400, got %d", resp.StatusCode)
+    }
+
+    resp = send("PATCH", update, `"1"`)
+    if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"2"` {
+        t.Errorf("update: expected 200 with ETag \"2\", got %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+    }
+
+    resp = send("PATCH", update, `"1"`)
+    if resp.StatusCode != http.StatusConflict || resp.Header.Get("ETag") != `"2"` {
+        t.Errorf("stale update: expected 409 with ETag \"2\", got %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+    }
+}
+
+// Opens the event stream of the harness user, events are decoded until
+// the test ends.
+func (h *apiHarness) events(t *testing.T) chan VaultEvent {
+    t.Helper()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    t.Cleanup(cancel)
+
+    resp := h.request(t, ctx, "GET", "/api/v1/home/events", nil, false)
+    if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+        resp.Body.Close()
+        t.Fatalf("unexpected event stream response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+    }
+
+    ch := make(chan VaultEvent, 16)
+    go func() {
+        defer resp.Body.Close()
+        defer close(ch)
+
+        scanner := bufio.NewScanner(resp.Body)
+        for scanner.Scan() {
+            if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+                var ev = VaultEvent{}
+                if json.Unmarshal([]byte(data), &ev) == nil {
+                    ch <- ev
+                }
+            }
+        }
+    }()
+    return ch
+}
+
+func expectEvent(t *testing.T, ch chan VaultEvent, expected VaultEvent) {
+    t.Helper()
+
+    select {
+    case ev, ok := <-ch:
+        if !ok {
+            t.Fatalf("event stream closed, expected %+v", expected)
+        }
+        if ev != expected {
+            t.Errorf("expected event %+v, got %+v", expected, ev)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatalf("no event arrived, expected %+v", expected)
+    }
+}
+
+// Streams have to end once their session is revoked.
+func TestEventsSessionRevoked(t *testing.T) {
+    heartbeat := eventHeartbeat
+    eventHeartbeat = 20 * time.Millisecond
+    defer func() { eventHeartbeat = heartbeat }()
+
+    h := newApiHarness(t)
+    h.login(t, "trent")
+    events := h.events(t)
+
+    h.run(t, []apiCase{
+        {name: "logout", method: "POST", path: "/api/v1/auth/logout",
+            status: http.StatusOK, envelope: "success"},
+    })
+
+    select {
+    case ev, ok := <-events:
+        if ok {
+            t.Errorf("unexpected event after logout: %+v", ev)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("event stream still open after logout")
+    }
+}
+
+func TestEventsRoute(t *testing.T) {
+    owner, member := newApiHarness(t), newApiHarness(t)
+    owner.login(t, "erin")
+    email := member.login(t, "faythe")
+
+    var container = Container{}
+    var category = Category{}
+    var store = Store{}
+    owner.run(t, []apiCase{
+        {name: "container create", method: "POST", path: "/api/v1/home/container",
+            body: jsonBody(ContainerRequest{Certificate: []byte("cert"), Encrypted: []byte("key")}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = ContainerResponse{}
+                decodeContent(t, content, &resp)
+                container = resp.Container
+            }},
+        {name: "member invite", method: "POST", path: "/api/v1/home/container/members/invite",
+            body: func() interface{} {
+                return MemberRequest{Container: container.Id, Email: email, Role: MemberRead, Encrypted: []byte("wrapped")}
+            },
+            status: http.StatusOK, envelope: "success"},
+    })
+
+    ownerEvents, memberEvents := owner.events(t), member.events(t)
+    owner.run(t, []apiCase{
+        {name: "category create", method: "POST", path: "/api/v1/categories",
+            body: jsonBody(CategoryParams{Name: "Shared"}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = CategoryResponse{}
+                decodeContent(t, content, &resp)
+                category = *resp.Created
+            }},
+        {name: "store create", method: "POST", path: "/api/v1/stores",
+            body: func() interface{} {
+                return StoreParam{Name: "Router", Container: container.Id, Category: category.Id, Content: []byte("sealed")}
+            },
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                decodeContent(t, content, &store)
+            }},
+        {name: "category update", method: "PATCH", path: "/api/v1/home/category",
+            body: func() interface{} {
+                return Category{Id: category.Id, Version: category.Version, CategoryParams: CategoryParams{Name: "Network"}}
+            },
+            status: http.StatusOK, envelope: "success"},
+    })
+
+    expectEvent(t, ownerEvents, VaultEvent{Kind: EventKindCategory, Action: EventCreate, Id: category.Id, Version: 1})
+    expectEvent(t, ownerEvents, VaultEvent{Kind: EventKindStore, Action: EventCreate, Id: store.Id, Version: 1})
+    expectEvent(t, ownerEvents, VaultEvent{Kind: EventKindCategory, Action: EventUpdate, Id: category.Id, Version: 2})
+
+    // The category only reaches the member through the shared store.
+    expectEvent(t, memberEvents, VaultEvent{Kind: EventKindStore, Action: EventCreate, Id: store.Id, Version: 1})
+    expectEvent(t, memberEvents, VaultEvent{Kind: EventKindCategory, Action: EventUpdate, Id: category.Id, Version: 2})
+
+    owner.run(t, []apiCase{
+        {name: "vault import", method: "POST", path: "/api/v1/home/import",
+            body: jsonBody(VaultExport{
+                Version: VaultExportVersion,
+                Containers: []Container{{Id: 1, Name: "Imported"}},
+                Stores: []Store{{Id: 1, StoreParam: StoreParam{Name: "Mail", Container: 1, Content: []byte("sealed")}}},
+            }),
+            status: http.StatusOK, envelope: "success"},
+    })
+
+    select {
+    case ev := <-ownerEvents:
+        if ev.Kind != EventKindStore || ev.Action != EventCreate {
+            t.Errorf("unexpected event after the vault import: %+v", ev)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("no event arrived after the vault import")
+    }
+}
+
+func TestResourceRoutes(t *testing.T) {
+    h := newApiHarness(t)
+    h.login(t, "frank")
+
+    var container = Container{}
+    var category = Category{}
+    var store = Store{}
+    h.ids = map[string]*int{"container": &container.Id, "category": &category.Id, "store": &store.Id}
+
+    h.run(t, []apiCase{
+        {name: "container create", method: "POST", path: "/api/v1/containers",
+            body: jsonBody(ContainerRequest{Name: "Personal", Certificate: []byte("cert"), Encrypted: []byte("key")}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = ContainerResponse{}
+                decodeContent(t, content, &resp)
+                container = resp.Container
+            }},
+        {name: "container get", method: "GET", path: "/api/v1/containers/{container}",
+            status: http.StatusOK, envelope: "success"},
+        {name: "container get invalid id", method: "GET", path: "/api/v1/containers/abc",
+            status: http.StatusBadRequest, envelope: "sys_invalid_params"},
+        {name: "container rename", method: "PATCH", path: "/api/v1/containers/{container}",
+            body: jsonBody(Container{Name: "Work"}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = Container{}
+                decodeContent(t, content, &resp)
+                if resp.Id != container.Id || resp.Name != "Work" {
+                    t.Errorf("unexpected renamed container: %s", content)
+                }
+            }},
+        {name: "category create", method: "POST", path: "/api/v1/categories",
+            body: jsonBody(CategoryParams{Name: "Social"}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = CategoryResponse{}
+                decodeContent(t, content, &resp)
+                category = *resp.Created
+            }},
+        {name: "category update", method: "PATCH", path: "/api/v1/categories/{category}",
+            body: func() interface{} { return Category{Version: category.Version, CategoryParams: CategoryParams{Name: "Friends"}} },
+            status: http.StatusOK, envelope: "success"},
+        {name: "store create", method: "POST", path: "/api/v1/stores",
+            body: func() interface{} { return StoreParam{Name: "GitHub", Category: category.Id, Content: []byte("sealed")} },
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                decodeContent(t, content, &store)
+            }},
+        {name: "stores by query", method: "GET", path: "/api/v1/stores?category={category}",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = StoreResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Stores) != 1 {
+                    t.Errorf("expected one store, got %s", content)
+                }
+            }},
+        {name: "category stores", method: "GET", path: "/api/v1/categories/{category}",
+            status: http.StatusOK, envelope: "success"},
+        {name: "store get", method: "GET", path: "/api/v1/stores/{store}",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = Store{}
+                decodeContent(t, content, &resp)
+                if resp.Id != store.Id || string(resp.Content) != "sealed" {
+                    t.Errorf("unexpected store: %s", content)
+                }
+            }},
+        {name: "store update", method: "PATCH", path: "/api/v1/stores/{store}",
+            body: func() interface{} { return Store{Version: store.Version, StoreParam: StoreParam{Name: "GitLab", Category: category.Id}} },
+            status: http.StatusOK, envelope: "success"},
+        {name: "store revisions", method: "GET", path: "/api/v1/stores/{store}/revisions",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = RevisionsResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Revisions) != 1 {
+                    t.Errorf("expected one revision, got %s", content)
+                }
+            }},
+        {name: "store delete", method: "DELETE", path: "/api/v1/stores/{store}",
+            status: http.StatusOK, envelope: "success"},
+        {name: "store get deleted", method: "GET", path: "/api/v1/stores/{store}",
+            status: http.StatusNotFound, envelope: "sys_not_found"},
+        {name: "trash restore", method: "POST", path: "/api/v1/trash/{store}/restore",
+            status: http.StatusOK, envelope: "success"},
+        {name: "store delete again", method: "DELETE", path: "/api/v1/stores/{store}",
+            status: http.StatusOK, envelope: "success"},
+        {name: "trash purge", method: "DELETE", path: "/api/v1/trash/{store}",
+            status: http.StatusOK, envelope: "success"},
+        {name: "trash empty", method: "DELETE", path: "/api/v1/trash",
+            status: http.StatusOK, envelope: "success"},
+        {name: "category delete", method: "DELETE", path: "/api/v1/categories/{category}",
+            status: http.StatusOK, envelope: "success"},
+        {name: "container delete", method: "DELETE", path: "/api/v1/containers/{container}",
+            status: http.StatusOK, envelope: "success"},
+        {name: "containers", method: "GET", path: "/api/v1/containers",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = ContainersResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Containers) != 0 {
+                    t.Errorf("expected no containers, got %s", content)
+                }
+            }},
+    })
+}
+
+func TestRequestValidation(t *testing.T) {
+    h := newApiHarness(t)
+    h.login(t, "grace")
+
+    var category = Category{}
+    var container = Container{}
+    h.ids = map[string]*int{"category": &category.Id, "container": &container.Id}
+    var oversized = make([]byte, vincaConfig.Limits.ContentLimit() + 1)
+
+    h.run(t, []apiCase{
+        {name: "container create", method: "POST", path: "/api/v1/containers",
+            body: jsonBody(ContainerRequest{Name: "Personal", Certificate: []byte("cert"), Encrypted: []byte("key")}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = ContainerResponse{}
+                decodeContent(t, content, &resp)
+                container = resp.Container
+            }},
+        {name: "container rename too long", method: "PATCH", path: "/api/v1/containers/{container}",
+            body: jsonBody(Container{Name: strings.Repeat("x", MaxNameLength + 1)}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("name")},
+        {name: "container rotate oversized", method: "POST", path: "/api/v1/home/container/rotate",
+            body: func() interface{} {
+                return ContainerRotateRequest{Id: container.Id, Certificate: []byte("cert2"), Encrypted: []byte("key2"),
+                    Stores: []StoreRotation{{Id: 1, Content: []byte("ok")}, {Id: 2, Content: oversized}},
+                    Members: []MemberKey{{Email: "x@example.com", Encrypted: oversized}}}
+            },
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("stores[1].content", "members[0].encrypted")},
+        {name: "member invite oversized", method: "POST", path: "/api/v1/home/container/members/invite",
+            body: func() interface{} {
+                return MemberRequest{Container: container.Id, Email: "x@example.com", Role: MemberRead, Encrypted: oversized}
+            },
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("encrypted")},
+        {name: "import commit oversized", method: "POST", path: "/api/v1/home/import/commit",
+            body: func() interface{} {
+                return ImportCommitRequest{Container: container.Id, Entries: []ImportStore{
+                    {Row: 2, Name: strings.Repeat("x", MaxNameLength + 1), Content: []byte("sealed")},
+                    {Row: 3, Name: "Mail", Content: oversized},
+                }}
+            },
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("entries[0].name", "entries[1].content")},
+        {name: "vault import oversized", method: "POST", path: "/api/v1/home/import",
+            body: func() interface{} {
+                return VaultExport{Version: VaultExportVersion, Stores: []Store{{StoreParam: StoreParam{Name: "Mail", Content: oversized}}}}
+            },
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("stores[0].content")},
+        {name: "category create", method: "POST", path: "/api/v1/categories",
+            body: jsonBody(CategoryParams{Name: "Social"}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = CategoryResponse{}
+                decodeContent(t, content, &resp)
+                category = *resp.Created
+            }},
+        {name: "category empty name", method: "POST", path: "/api/v1/categories",
+            body: jsonBody(CategoryParams{Name: " ", Icon: -1}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("name", "icon")},
+        {name: "category unknown field", method: "POST", path: "/api/v1/categories",
+            body: jsonBody(map[string]interface{}{"name": "Mail", "colour": 3}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("colour")},
+        {name: "category update mistyped", method: "PATCH", path: "/api/v1/categories/{category}",
+            body: jsonBody(map[string]interface{}{"name": "Mail", "icon": "star"}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("icon")},
+        {name: "category delete into itself", method: "DELETE", path: "/api/v1/categories/{category}",
+            body: func() interface{} { return CategoryDestroyRequest{Migrate: category.Id} },
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("migrate")},
+        {name: "store oversized content", method: "POST", path: "/api/v1/stores",
+            body: func() interface{} { return StoreParam{Name: "Blob", Category: category.Id, Content: oversized} },
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("content")},
+        {name: "store without name", method: "POST", path: "/api/v1/stores",
+            body: func() interface{} { return StoreParam{Category: category.Id, Color: -1} },
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("name", "color")},
+        {name: "container without keys", method: "POST", path: "/api/v1/containers",
+            body: jsonBody(ContainerRequest{Name: "Empty"}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("certificate", "encrypted")},
+        {name: "request too large", method: "POST", path: "/api/v1/categories",
+            body: jsonBody(CategoryParams{Name: strings.Repeat("x", int(vincaConfig.Limits.BodyLimit()))}),
+            status: http.StatusRequestEntityTooLarge, envelope: "sys_request_too_large"},
+    })
+}
+
+// Every authenticated route must refuse requests without a session.
+func TestRoutesRequireSession(t *testing.T) {
+    h := newApiHarness(t)
+
+    for path, route := range vincaMux.routes {
+        if strings.HasPrefix(path, "/api/v1/auth") {
+            continue
+        }
+        path = strings.ReplaceAll(path, "{id}", "1")
+
+        for _, mt := range route.methods {
+            status, envelope := h.call(t, mt.method, path, nil, true)
+            if status != http.StatusUnauthorized || envelope.Status != ErrInvalidSession.Error() {
+                t.Errorf("%s %s: expected 401 %q, got %d %q", mt.method, path,
+                        ErrInvalidSession.Error(), status, envelope.Status)
+            }
+        }
+    }
+}
+
+func TestTrashShared(t *testing.T) {
+    owner, member := newApiHarness(t), newApiHarness(t)
+    owner.login(t, "mallory")
+    email := member.login(t, "niaj")
+
+    _, envelope := owner.call(t, "POST", "/api/v1/home/container",
+            ContainerRequest{Certificate: []byte("cert"), Encrypted: []byte("key")}, false)
+    var created = ContainerResponse{}
+    decodeContent(t, envelope.Content, &created)
+    container := created.Container
+
+    var stores = make([]Store, 2)
+    var cases = []apiCase{
+        {name: "member invite", method: "POST", path: "/api/v1/home/container/members/invite",
+            body: func() interface{} {
+                return MemberRequest{Container: container.Id, Email: email, Role: MemberWrite, Encrypted: []byte("wrapped")}
+            },
+            status: http.StatusOK, envelope: "success"},
+    }
+    for i := range stores {
+        st := &stores[i]
+        cases = append(cases, apiCase{name: "store create", method: "POST", path: "/api/v1/stores",
+            body: func() interface{} { return StoreParam{Name: "Router", Container: container.Id, Content: []byte("sealed")} },
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                decodeContent(t, content, st)
+            }})
+    }
+    cases = append(cases, apiCase{name: "store delete", method: "POST", path: "/api/v1/home/store/delete",
+        body: func() interface{} { return Store{Id: stores[0].Id} },
+        status: http.StatusOK, envelope: "success"})
+    owner.run(t, cases)
+
+    member.run(t, []apiCase{
+        {name: "member trash empty", method: "POST", path: "/api/v1/home/trash/empty",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = TrashEmptyResponse{}
+                decodeContent(t, content, &resp)
+                if resp.Purged != 0 {
+                    t.Errorf("member purged the owner trash: %s", content)
+                }
+            }},
+    })
+
+    trashed := func(expected int) apiCase {
+        return apiCase{name: "owner trash", method: "GET", path: "/api/v1/home/trash",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = TrashResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Stores) != 1 || resp.Stores[0].Id != stores[expected].Id {
+                    t.Errorf("expected store %d in the trash, got %s", stores[expected].Id, content)
+                }
+            }}
+    }
+    owner.run(t, []apiCase{trashed(0)})
+
+    // Only the store trashed longer than the retention ago is purged.
+    db := vincaRepository.(*VincaDatabase).db
+    if _, err := db.Exec("update stores set deleted_at = datetime(deleted_at, '-2 hours') where id = ?", stores[0].Id); err != nil {
+        t.Fatal("unable to backdate trashed store:", err)
+    }
+    owner.run(t, []apiCase{
+        {name: "store delete recent", method: "POST", path: "/api/v1/home/store/delete",
+            body: func() interface{} { return Store{Id: stores[1].Id} },
+            status: http.StatusOK, envelope: "success"},
+    })
+    vincaRepository.PurgeExpiredTrash(context.Background(), time.Hour)
+    owner.run(t, []apiCase{trashed(1)})
+}
+
+// Stores may only reference categories of their container owner, other
+// categories must neither be assigned nor leak through listings.
+func TestCategoryIsolation(t *testing.T) {
+    owner, member, stranger := newApiHarness(t), newApiHarness(t), newApiHarness(t)
+    owner.login(t, "olivia")
+    email := member.login(t, "peggy")
+    stranger.login(t, "rupert")
+
+    var containers = make(map[*apiHarness]Container)
+    for _, h := range []*apiHarness{owner, member, stranger} {
+        _, envelope := h.call(t, "POST", "/api/v1/home/container",
+                ContainerRequest{Certificate: []byte("cert"), Encrypted: []byte("key")}, false)
+        var resp = ContainerResponse{}
+        decodeContent(t, envelope.Content, &resp)
+        containers[h] = resp.Container
+    }
+    shared := containers[owner]
+
+    createCategory := func(h *apiHarness, name string) Category {
+        _, envelope := h.call(t, "POST", "/api/v1/categories", CategoryParams{Name: name}, false)
+        var resp = CategoryResponse{}
+        decodeContent(t, envelope.Content, &resp)
+        return *resp.Created
+    }
+    secret := createCategory(owner, "SecretBank")
+    mine := createCategory(member, "Mine")
+
+    owner.run(t, []apiCase{
+        {name: "member invite", method: "POST", path: "/api/v1/home/container/members/invite",
+            body: jsonBody(MemberRequest{Container: shared.Id, Email: email, Role: MemberWrite, Encrypted: []byte("wrapped")}),
+            status: http.StatusOK, envelope: "success"},
+    })
+
+    var store = Store{}
+    hidden := func(t *testing.T, content json.RawMessage) {
+        if strings.Contains(string(content), "SecretBank") {
+            t.Errorf("foreign category leaked: %s", content)
+        }
+    }
+    stranger.run(t, []apiCase{
+        {name: "store create foreign category", method: "POST", path: "/api/v1/stores",
+            body: jsonBody(StoreParam{Name: "Bank", Container: containers[stranger].Id, Category: secret.Id, Content: []byte("sealed")}),
+            status: http.StatusForbidden, envelope: "sys_forbidden"},
+        {name: "store create", method: "POST", path: "/api/v1/stores",
+            body: jsonBody(StoreParam{Name: "Bank", Container: containers[stranger].Id, Content: []byte("sealed")}),
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                decodeContent(t, content, &store)
+            }},
+        {name: "store update foreign category", method: "PATCH", path: "/api/v1/home/store",
+            body: func() interface{} {
+                var update = store
+                update.Category = secret.Id
+                return update
+            },
+            status: http.StatusForbidden, envelope: "sys_forbidden"},
+        {name: "categories", method: "GET", path: "/api/v1/home/categories",
+            status: http.StatusOK, envelope: "success", check: hidden},
+        {name: "sync", method: "GET", path: "/api/v1/sync",
+            status: http.StatusOK, envelope: "success", check: hidden},
+    })
+
+    member.ids = map[string]*int{"container": &shared.Id}
+    member.run(t, []apiCase{
+        {name: "shared store own category", method: "POST", path: "/api/v1/stores",
+            body: jsonBody(StoreParam{Name: "Router", Container: shared.Id, Category: mine.Id, Content: []byte("sealed")}),
+            status: http.StatusForbidden, envelope: "sys_forbidden"},
+        {name: "shared store owner category", method: "POST", path: "/api/v1/stores",
+            body: jsonBody(StoreParam{Name: "Router", Container: shared.Id, Category: secret.Id, Content: []byte("sealed")}),
+            status: http.StatusOK, envelope: "success"},
+        {name: "shared container categories", method: "GET", path: "/api/v1/containers/{container}",
+            status: http.StatusOK, envelope: "success",
+            check: func(t *testing.T, content json.RawMessage) {
+                var resp = ContainerResponse{}
+                decodeContent(t, content, &resp)
+                if len(resp.Categories) != 1 || resp.Categories[0].Id != secret.Id {
+                    t.Errorf("expected the owner category, got %s", content)
+                }
+            }},
+    })
+}
+
+// Session storage that is unable to create sessions.
+type failingSessions struct {
+    SessionContainer
+}
+
+func (failingSessions) CreateSession(ctx context.Context, usr *User, remoteAddr, userAgent string) uuid.UUID {
+    return uuid.Nil
+}
+
+func TestLoginStorageFailure(t *testing.T) {
+    h := newApiHarness(t)
+    email := h.login(t, "sybil")
+
+    h.run(t, []apiCase{
+        {name: "default container missing", method: "GET", path: "/api/v1/home/container",
+            status: http.StatusNotFound, envelope: "sys_not_found"},
+    })
+
+    sessions := vincaSessions
+    vincaSessions = failingSessions{sessions}
+    defer func() { vincaSessions = sessions }()
+
+    var params = UserParam{Email: email, Password: testPassword(strings.Split(email, "@")[0])}
+    if status, envelope := h.call(t, "POST", "/api/v1/auth/login", params, true); status != http.StatusInternalServerError || envelope.Status != "sys_internal" {
+        t.Errorf("expected an internal error, got %d %s %s", status, envelope.Status, envelope.Content)
+    }
+}
+
+// Repository failing every category lookup, the remaining methods are
+// served by the wrapped one.
+type failingCategories struct {
+    Repository
+}
+
+func (failingCategories) FetchCategories(ctx context.Context, usr *User) ([]*Category, error) {
+    return nil, errors.New("storage unavailable")
+}
+
+// Handlers have to use the assigned repository and surface its errors.
+func TestRepositorySwap(t *testing.T) {
+    h := newApiHarness(t)
+    h.login(t, "uma")
+
+    repository := vincaRepository
+    vincaRepository = failingCategories{repository}
+    defer func() { vincaRepository = repository }()
+
+    h.run(t, []apiCase{
+        {name: "categories", method: "GET", path: "/api/v1/home/categories",
+            status: http.StatusInternalServerError, envelope: "sys_internal"},
+    })
+}
+
+// Notifier keeping the last message instead of delivering it.
+type capturingNotifier struct {
+    message string
+}
+
+func (cn *capturingNotifier) Notify(ctx context.Context, usr *User, subject, message string) error {
+    cn.message = message
+    return nil
+}
+
+// Reset passwords go through the same policy as registration, a rejected
+// password leaves the token usable.
+func TestResetConfirmPolicy(t *testing.T) {
+    h := newApiHarness(t)
+    email := h.login(t, "alice")
+    username := strings.Split(email, "@")[0]
+
+    notifier := vincaNotifier
+    captured := &capturingNotifier{}
+    vincaNotifier = captured
+    defer func() { vincaNotifier = notifier }()
+
+    h.run(t, []apiCase{
+        {name: "reset", method: "POST", path: "/api/v1/auth/reset", anonymous: true,
+            body: jsonBody(ResetRequest{Email: email}),
+            status: http.StatusOK, envelope: "success"},
+    })
+    token := strings.TrimPrefix(captured.message, "Your password reset token: ")
+
+    h.run(t, []apiCase{
+        {name: "reset confirm breached", method: "POST", path: "/api/v1/auth/reset/confirm", anonymous: true,
+            body: jsonBody(ResetConfirmRequest{Token: token, Password: "password123"}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("password", "password")},
+        {name: "reset confirm username", method: "POST", path: "/api/v1/auth/reset/confirm", anonymous: true,
+            body: jsonBody(ResetConfirmRequest{Token: token, Password: username + username}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("password")},
+        {name: "reset confirm email", method: "POST", path: "/api/v1/auth/reset/confirm", anonymous: true,
+            body: jsonBody(ResetConfirmRequest{Token: token, Password: email}),
+            status: http.StatusUnprocessableEntity, envelope: "sys_validation",
+            check: expectFields("password")},
+        {name: "reset confirm", method: "POST", path: "/api/v1/auth/reset/confirm", anonymous: true,
+            body: jsonBody(ResetConfirmRequest{Token: token, Password: "Lanterns glow at 9 dusk"}),
+            status: http.StatusOK, envelope: "success"},
+        {name: "reset confirm consumed", method: "POST", path: "/api/v1/auth/reset/confirm", anonymous: true,
+            body: jsonBody(ResetConfirmRequest{Token: token, Password: "Lanterns glow at 9 dusk"}),
+            status: http.StatusBadRequest, envelope: "user_reset_invalid"},
+    })
+}
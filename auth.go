@@ -2,24 +2,76 @@ package main
 
 import "github.com/google/uuid"
 import "net/http"
-import "log"
+import "sort"
+import "time"
 
-const AuthSessionUser int = 0x1001
+var AuthSessionUser = NewContextKey[*User]("session user")
+var AuthSessionId = NewContextKey[uuid.UUID]("session id")
 
 var ErrInvalidLogin = NewHandlerErr("user_login_invalid", http.StatusUnauthorized)
-var ErrInvalidData = NewHandlerErr("user_data_invalid", http.StatusBadRequest)
+var ErrLoginLocked = NewHandlerErr("user_login_locked", http.StatusTooManyRequests)
 var ErrInvalidSession = NewHandlerErr("user_session_invalid", http.StatusUnauthorized)
+var ErrInvalidResetToken = NewHandlerErr("user_reset_invalid", http.StatusBadRequest)
+var ErrInvalidTwoFactor = NewHandlerErr("user_2fa_invalid", http.StatusUnauthorized)
+var ErrTwoFactorEnabled = NewHandlerErr("user_2fa_enabled", http.StatusBadRequest)
+var ErrTwoFactorDisabled = NewHandlerErr("user_2fa_disabled", http.StatusBadRequest)
 
 type LoginResponse struct {
-    Uuid string `json:"uuid"`
-    User
+    Uuid string `json:"uuid,omitempty"`
+    Pending string `json:"pending,omitempty"`
+    *User
+}
+
+type LoginTwoFactorRequest struct {
+    Pending string `json:"pending"`
+    Code string `json:"code"`
+}
+
+type TwoFactorEnrollResponse struct {
+    Secret string `json:"secret"`
+    Uri string `json:"uri"`
+}
+
+type TwoFactorRequest struct {
+    Code string `json:"code"`
+    Confirmation string `json:"confirmation,omitempty"`
+}
+
+type TwoFactorVerifyResponse struct {
+    RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type LogoutResponse struct {
+    Removed int `json:"removed"`
+}
+
+type SessionRevokeRequest struct {
+    Id string `json:"id"`
+}
+
+type ResetRequest struct {
+    Email string `json:"email"`
+}
+
+type ResetConfirmRequest struct {
+    Token string `json:"token"`
+    Password string `json:"password"`
 }
 
 func init() {
     vincaMux.NewRoute("/api/v1/auth/login").Handle(api_auth_login, "POST")
+    vincaMux.NewRoute("/api/v1/auth/login/2fa").Handle(api_auth_login_2fa, "POST")
     vincaMux.NewRoute("/api/v1/auth/register").Handle(api_auth_register, "POST")
     vincaMux.NewRoute("/api/v1/auth/reset").Handle(api_auth_reset, "POST")
-    vincaMux.NewRoute("/api/v1/auth/session").Middleware(auth_middleware).Handle(api_auth_session, "GET")
+    vincaMux.NewRoute("/api/v1/auth/reset/confirm").Handle(api_auth_reset_confirm, "POST")
+    vincaMux.NewRoute("/api/v1/auth/session").Middleware(auth_middleware).HandleAuth(api_auth_session, "GET")
+    vincaMux.NewRoute("/api/v1/auth/logout").Middleware(auth_middleware).HandleAuth(api_auth_logout, "POST")
+    vincaMux.NewRoute("/api/v1/auth/logout/all").Middleware(auth_middleware).HandleAuth(api_auth_logout_all, "POST")
+    vincaMux.NewRoute("/api/v1/auth/sessions").Middleware(auth_middleware).HandleAuth(api_auth_sessions, "GET")
+    vincaMux.NewRoute("/api/v1/auth/sessions/revoke").Middleware(auth_middleware).HandleAuth(api_auth_session_revoke, "POST")
+    vincaMux.NewRoute("/api/v1/auth/2fa/enroll").Middleware(auth_middleware).HandleAuth(api_auth_2fa_enroll, "POST")
+    vincaMux.NewRoute("/api/v1/auth/2fa/verify").Middleware(auth_middleware).HandleAuth(api_auth_2fa_verify, "POST")
+    vincaMux.NewRoute("/api/v1/auth/2fa/disable").Middleware(auth_middleware).HandleAuth(api_auth_2fa_disable, "POST")
 }
 
 func api_auth_login(r *Request) interface{} {
@@ -28,19 +80,77 @@ func api_auth_login(r *Request) interface{} {
         return err
     }
 
-    usr := vincaDatabase.FetchUser(params.Email)
+    account, address := LoginAccountKey(params.Email), LoginAddressKey(r.RemoteHost())
+    if err := vincaLoginGuard.Attempt(r.Context(), account, address); err != nil {
+        return err
+    }
+
+    usr := vincaRepository.FetchUser(r.Context(), params.Email)
     if usr == nil {
-        log.Println("unable to find requested user")
+        r.Logger().Info("login for unknown user")
         return ErrInvalidLogin
     }
 
-    if !usr.Authenticate(params.Password) {
-        log.Println("nah, invalid password, try again")
+    if !usr.Authenticate(r.Context(), params.Password) {
+        r.Logger().Info("login with invalid password", "user", usr)
+        return ErrInvalidLogin
+    }
+    vincaLoginGuard.Release(address)
+
+    // The account counter is only cleared once the second factor passed,
+    // otherwise new pending logins would allow guessing codes forever.
+    if usr.TwoFactor {
+        pending := vincaPendingLogins.Create(r.Context(), usr)
+        if pending == "" {
+            return ErrInternal
+        }
+        return LoginResponse{Pending: pending}
+    }
+    vincaLoginGuard.Succeeded(account)
+
+    suid := vincaSessions.CreateSession(r.Context(), usr, r.RemoteHost(), r.UserAgent())
+    if suid == uuid.Nil {
+        return ErrInternal
+    }
+
+    return LoginResponse{Uuid: suid.String(), User: usr}
+}
+
+func api_auth_login_2fa(r *Request) interface{} {
+    var req = LoginTwoFactorRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    uid, ok := vincaPendingLogins.Attempt(req.Pending)
+    if !ok {
+        return ErrInvalidLogin
+    }
+
+    usr := vincaRepository.FetchUserById(r.Context(), uid)
+    if usr == nil {
         return ErrInvalidLogin
     }
-    suid := vincaSessions.CreateSession(usr)
 
-    return LoginResponse{Uuid: suid.String(), User: *usr}
+    account, address := LoginAccountKey(usr.Email), LoginAddressKey(r.RemoteHost())
+    if err := vincaLoginGuard.Attempt(r.Context(), account, address); err != nil {
+        return err
+    }
+
+    if !vincaRepository.VerifySecondFactor(r.Context(), usr, req.Code) {
+        r.Logger().Info("login with invalid second factor", "user", usr)
+        return ErrInvalidTwoFactor
+    }
+    vincaLoginGuard.Succeeded(account)
+    vincaLoginGuard.Release(address)
+    vincaPendingLogins.Remove(req.Pending)
+
+    suid := vincaSessions.CreateSession(r.Context(), usr, r.RemoteHost(), r.UserAgent())
+    if suid == uuid.Nil {
+        return ErrInternal
+    }
+
+    return LoginResponse{Uuid: suid.String(), User: usr}
 }
 
 func api_auth_register(r *Request) interface{} {
@@ -49,43 +159,211 @@ func api_auth_register(r *Request) interface{} {
         return err
     }
 
-    if !usr.Valid() {
-        log.Println("invalid user data received, try again")
-        return ErrInvalidData
+    if err := usr.ValidateRegistration(); err != nil {
+        r.Logger().Info("invalid registration data", "user", usr.UserParam)
+        return err
     }
 
-    if err := vincaDatabase.UserSave(&usr); err != nil {
+    if err := vincaRepository.UserSave(r.Context(), &usr); err != nil {
         return err
     }
     return usr
 }
 
+// Always answers with success, so the endpoint can not be used to probe
+// for registered email addresses.
 func api_auth_reset(r *Request) interface{} {
-    var usr = User{}
-    if err := r.Decode(&usr.UserParam); err != nil {
+    var req = ResetRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    usr := vincaRepository.FetchUser(r.Context(), req.Email)
+    if usr == nil {
+        return req
+    }
+
+    token, hash, err := NewResetToken()
+    if err != nil {
+        r.Logger().Error("unable to generate reset token", "err", err)
+        return err
+    }
+
+    if err := vincaRepository.SaveResetToken(r.Context(), usr, hash, vincaConfig.ResetLifetime()); err != nil {
+        return err
+    }
+
+    if err := vincaNotifier.Notify(r.Context(), usr, "Password reset", "Your password reset token: " + token); err != nil {
+        r.Logger().Error("unable to deliver reset token", "err", err)
+    }
+    return req
+}
+
+func api_auth_reset_confirm(r *Request) interface{} {
+    var req = ResetConfirmRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    uid, err := vincaRepository.FetchResetToken(r.Context(), req.Token)
+    if err != nil {
+        return err
+    }
+
+    usr := vincaRepository.FetchUserById(r.Context(), uid)
+    if usr == nil {
+        return ErrInvalidResetToken
+    }
+
+    if err := req.ValidatePassword(usr); err != nil {
+        return err
+    }
+
+    if _, err := vincaRepository.ConsumeResetToken(r.Context(), req.Token); err != nil {
+        return err
+    }
+
+    if err := usr.SetPassword(r.Context(), req.Password); err != nil {
+        return err
+    }
+
+    if err := vincaRepository.UpdatePassword(r.Context(), usr); err != nil {
         return err
     }
-    log.Println("Restore password:", usr)
+    vincaSessions.RemoveUserSessions(r.Context(), usr.Id, uuid.Nil)
 
     return usr
 }
 
-func api_auth_session(r *Request) interface{} {
-    if usr, valid := r.Value(AuthSessionUser).(*User); valid {
-        return usr
+func api_auth_session(r *Request, usr *User) interface{} {
+    return usr
+}
+
+func api_auth_logout(r *Request, _ *User) interface{} {
+    return LogoutResponse{
+        Removed: vincaSessions.RemoveSession(r.Context(), r.SessionId()),
+    }
+}
+
+func api_auth_logout_all(r *Request, usr *User) interface{} {
+    return LogoutResponse{
+        Removed: vincaSessions.RemoveUserSessions(r.Context(), usr.Id, uuid.Nil),
+    }
+}
+
+func api_auth_sessions(r *Request, usr *User) interface{} {
+    current := r.SessionId()
+
+    var sessions = []SessionInfo{}
+    for suid, session := range vincaSessions.UserSessions(r.Context(), usr.Id) {
+        info := session.Info(suid)
+        info.Current = suid == current
+        sessions = append(sessions, info)
+    }
+
+    sort.Slice(sessions, func(i, j int) bool {
+        return sessions[i].LastSeen.After(sessions[j].LastSeen)
+    })
+    return sessions
+}
+
+func api_auth_session_revoke(r *Request, usr *User) interface{} {
+    var req = SessionRevokeRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    for suid, session := range vincaSessions.UserSessions(r.Context(), usr.Id) {
+        if SessionPublicId(suid) == req.Id {
+            vincaSessions.RemoveSession(r.Context(), suid)
+            return session.Info(suid)
+        }
+    }
+    // Not the invalid session error, clients drop their own session on it.
+    return ErrNotFound
+}
+
+func api_auth_2fa_enroll(r *Request, usr *User) interface{} {
+    if usr.TwoFactor {
+        return ErrTwoFactorEnabled
+    }
+
+    secret, err := NewTotpSecret()
+    if err != nil {
+        r.Logger().Error("unable to generate totp secret", "err", err)
+        return err
+    }
+
+    if err := vincaRepository.SaveTotpSecret(r.Context(), usr, secret); err != nil {
+        return err
+    }
+
+    return TwoFactorEnrollResponse{
+        Secret: totpEncoding.EncodeToString(secret),
+        Uri: TotpURI(usr, secret),
     }
-    return ErrInvalidSession
+}
+
+func api_auth_2fa_verify(r *Request, usr *User) interface{} {
+    var req = TwoFactorRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    if usr.TwoFactor {
+        return ErrTwoFactorEnabled
+    }
+
+    step, ok := TotpMatch(usr.totpSecret, req.Code, time.Now())
+    if !ok || !vincaRepository.ConsumeTotpStep(r.Context(), usr, step) {
+        return ErrInvalidTwoFactor
+    }
+
+    codes, err := NewRecoveryCodes()
+    if err != nil {
+        r.Logger().Error("unable to generate recovery codes", "err", err)
+        return err
+    }
+
+    if err := vincaRepository.EnableTotp(r.Context(), usr, codes); err != nil {
+        return err
+    }
+    return TwoFactorVerifyResponse{RecoveryCodes: codes}
+}
+
+func api_auth_2fa_disable(r *Request, usr *User) interface{} {
+    var req = TwoFactorRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    if !usr.TwoFactor {
+        return ErrTwoFactorDisabled
+    }
+
+    if !usr.Authenticate(r.Context(), req.Confirmation) {
+        return ErrInvalidPassword
+    }
+
+    if !vincaRepository.VerifySecondFactor(r.Context(), usr, req.Code) {
+        return ErrInvalidTwoFactor
+    }
+
+    if err := vincaRepository.DisableTotp(r.Context(), usr); err != nil {
+        return err
+    }
+    return usr
 }
 
 func auth_middleware(r *Request) error {
-    log.Println("auth_middleware")
     suid, err := uuid.Parse(r.Header.Get("Vinca-Authentication"))
     if err != nil {
-        return err
+        return ErrInvalidSession
     }
 
-    if usr := vincaSessions.SessionUser(suid); usr != nil {
-        r.WithValue(AuthSessionUser, usr)
+    if usr := vincaSessions.SessionUser(r.Context(), suid); usr != nil {
+        WithContextValue(r, AuthSessionUser, usr)
+        WithContextValue(r, AuthSessionId, suid)
         return nil
     }
     return ErrInvalidSession
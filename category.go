@@ -1,6 +1,12 @@
 package main
 
-import "log"
+import "context"
+import "log/slog"
+
+// Categories of other users are only visible through the stores of a
+// container shared with the user, and only when the container owner owns
+// the category. Takes the user id once.
+const sqlCategoryShared = "id in (select s.category_id from stores s join containers c on c.id = s.container_id join container_members m on m.container_id = c.id where m.user_id = ? and s.deleted_at is null and c.user_id = categories.user_id)"
 
 type CategoryDestroyRequest struct {
     Id int `json:"id"`
@@ -15,116 +21,173 @@ type CategoryParams struct {
 
 type Category struct {
     Id int `json:"id"`
+    Version int `json:"version"`
     CategoryParams
 }
 
-func (v *VincaDatabase) FetchCategories(usr *User) []*Category {
-    rows, err := v.db.Query("select id, name, description, icon from categories where user_id = ? order by name asc", usr.Id)
+func (ct Category) ETag() string {
+    return VersionETag(ct.Version)
+}
+
+func (v *VincaDatabase) FetchCategories(ctx context.Context, usr *User) ([]*Category, error) {
+    rows, err := v.db.Query("select id, name, description, icon, version from categories where user_id = ? or " + sqlCategoryShared + " order by name asc",
+            usr.Id, usr.Id)
     if err != nil {
-        log.Println("unable to fetch categories for user", usr.Username)
-        return nil
+        slog.ErrorContext(ctx, "unable to fetch categories", "user", usr, "err", err)
+        return nil, err
     }
 
     var categories []*Category
     for rows.Next() {
         var category = &Category{}
-        if err = rows.Scan(&category.Id, &category.Name, &category.Description, &category.Icon); err != nil {
-            log.Println("category fetch err:", err)
+        if err = rows.Scan(&category.Id, &category.Name, &category.Description, &category.Icon, &category.Version); err != nil {
+            slog.ErrorContext(ctx, "category fetch err", "err", err)
             continue
         }
         categories = append(categories, category)
     }
-    return categories
+    return categories, nil
+}
+
+// Categories of the container owner, members only get the ones used by
+// stores of the container.
+func (v *VincaDatabase) FetchContainerCategories(ctx context.Context, container *Container, usr *User) ([]*Category, error) {
+    rows, err := v.db.Query("select id, name, description, icon, version from categories where user_id = (select user_id from containers where id = ?) and (user_id = ? or id in (select category_id from stores where container_id = ? and deleted_at is null)) order by name asc",
+            container.Id, usr.Id, container.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch container categories", "container", container.Id, "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var categories []*Category
+    for rows.Next() {
+        var category = &Category{}
+        if err = rows.Scan(&category.Id, &category.Name, &category.Description, &category.Icon, &category.Version); err != nil {
+            slog.ErrorContext(ctx, "category fetch err", "err", err)
+            continue
+        }
+        categories = append(categories, category)
+    }
+    return categories, nil
+}
+
+// Stores only reference categories of their container owner, category 0
+// leaves the store uncategorized.
+func (v *VincaDatabase) CheckStoreCategory(ctx context.Context, st *Store) error {
+    if st.Category == 0 {
+        return nil
+    }
+
+    var count int
+    err := v.db.QueryRow("select count(*) from categories c join containers o on o.user_id = c.user_id where c.id = ? and o.id = ?",
+            st.Category, st.Container).Scan(&count)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to check store category", "err", err)
+        return err
+    }
+
+    if count != 1 {
+        return ErrForbidden
+    }
+    return nil
 }
 
-func (v *VincaDatabase) FetchCategory(ct *Category, usr *User) error {
-    err := v.db.QueryRow("select name, description, icon from categories where id = ? and user_id = ?",
-            ct.Id, usr.Id).Scan(&ct.Name, &ct.Description, &ct.Icon)
+// Categories stay owned by a single user, members of shared containers only
+// see the ones used by shared stores and can not modify them.
+func (v *VincaDatabase) FetchCategory(ctx context.Context, ct *Category, usr *User) error {
+    err := v.db.QueryRow("select name, description, icon, version from categories where id = ? and user_id = ?",
+            ct.Id, usr.Id).Scan(&ct.Name, &ct.Description, &ct.Icon, &ct.Version)
     if err != nil {
-        log.Println("unable to fetch category from database:", err)
+        slog.ErrorContext(ctx, "unable to fetch category from database", "err", err)
         return err
     }
     return nil
 }
 
-func (v *VincaDatabase) SaveCategory(ct *Category, usr *User) error {
-    res, err := v.db.Exec("insert into categories(user_id, name, description, icon) values(?,?,?,?)",
+func (v *VincaDatabase) SaveCategory(ctx context.Context, ct *Category, usr *User) error {
+    res, err := v.db.Exec("insert into categories(user_id, name, description, icon, version) values(?,?,?,?,1)",
                         usr.Id, ct.Name, ct.Description, ct.Icon)
     if err != nil {
-        log.Println("unable to save category to db:", err)
+        slog.ErrorContext(ctx, "unable to save category to db", "err", err)
         return err
     }
 
     cid, err := res.LastInsertId()
     if err != nil {
-        log.Println("unable to fetch id from table.")
+        slog.ErrorContext(ctx, "unable to fetch category id", "err", err)
         return nil
     }
 
     ct.Id = int(cid)
+    ct.Version = 1
     return nil
 }
 
-func (v *VincaDatabase) UpdateCategory(ct *Category, usr *User) error {
-    res, err := v.db.Exec("update categories set name = ?, description = ?, icon = ? where id = ? and user_id = ?",
-            ct.Name, ct.Description, ct.Icon, ct.Id, usr.Id)
+// Updates the category only when ct.Version matches the stored version.
+func (v *VincaDatabase) UpdateCategory(ctx context.Context, ct *Category, usr *User) error {
+    res, err := v.db.Exec("update categories set name = ?, description = ?, icon = ?, version = version + 1, modified = current_timestamp where id = ? and version = ? and user_id = ?",
+            ct.Name, ct.Description, ct.Icon, ct.Id, ct.Version, usr.Id)
 
     if err != nil {
-        log.Println("unable to update category:", err)
+        slog.ErrorContext(ctx, "unable to update category", "err", err)
         return err
     }
 
     rows, err := res.RowsAffected()
     if err != nil {
-        log.Println("Unable to fetch affected rows from db:", err)
+        slog.ErrorContext(ctx, "Unable to fetch affected rows from db", "err", err)
         return nil
     }
 
     if rows != 1 {
-        log.Println("category update affected different row count:", rows)
+        slog.InfoContext(ctx, "stale category update rejected", "category", ct.Id, "version", ct.Version)
+        return ErrStaleWrite
     }
+    ct.Version++
     return nil
 }
 
-func (v *VincaDatabase) MigrateCategory(ct, migrate *Category, usr *User) error {
+func (v *VincaDatabase) MigrateCategory(ctx context.Context, ct, migrate *Category, usr *User) error {
     if migrate.Id != 0 {
-        if err := v.FetchCategory(migrate, usr); err != nil {
-            log.Println("unable to migrate to invalid category:", err)
+        if err := v.FetchCategory(ctx, migrate, usr); err != nil {
+            slog.ErrorContext(ctx, "unable to migrate to invalid category", "err", err)
             return err
         }
     }
 
-    res, err := v.db.Exec("update stores set category_id = ? where category_id = ? and user_id = ?",
+    res, err := v.db.Exec("update stores set category_id = ?, modified = current_timestamp where category_id = ? and user_id = ?",
             migrate.Id, ct.Id, usr.Id)
     if err != nil {
-        log.Println("unable to move stores into migration category:", err)
+        slog.ErrorContext(ctx, "unable to move stores into migration category", "err", err)
         return err
     }
 
     rows, err := res.RowsAffected()
     if err != nil {
-        log.Println("error while counting affected rows for category migration:", err)
+        slog.ErrorContext(ctx, "error while counting affected rows for category migration", "err", err)
         return nil
     }
-    log.Println("category migration for", usr.Id, "affected", rows)
+    slog.DebugContext(ctx, "category migrated", "user", usr, "affected", rows)
     return nil
 }
 
-func (v *VincaDatabase) DestroyCategory(ct *Category, usr *User) error {
+func (v *VincaDatabase) DestroyCategory(ctx context.Context, ct *Category, usr *User) error {
     res, err := v.db.Exec("delete from categories where id = ? and user_id = ?", ct.Id, usr.Id)
     if err != nil {
-        log.Println("unable to remove category from database:", err)
+        slog.ErrorContext(ctx, "unable to remove category from database", "err", err)
         return err
     }
+    v.SaveTombstone(ctx, usr.Id, 0, TombstoneCategory, ct.Id)
 
     rows, err := res.RowsAffected()
     if err != nil {
-        log.Println("unable to fetch rows remove count:", err)
+        slog.ErrorContext(ctx, "unable to fetch rows remove count", "err", err)
         return nil
     }
 
     if rows != 1 {
-        log.Println("something bad happened, different affected row count:", rows)
+        slog.WarnContext(ctx, "category removal affected different row count", "affected", rows)
     }
     return nil
 }
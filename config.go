@@ -1,26 +1,144 @@
 package main
 
 import "os"
-import "log"
+import "log/slog"
+import "time"
 import "encoding/json"
 
 type VincaConfig struct {
+    Driver string `json:"driver"`
     Database string `json:"database"`
+    Sessions SessionConfig `json:"sessions"`
+    Notifier NotifierConfig `json:"notifier"`
+    ResetTimeout int `json:"reset_timeout"`
+    Lockout LockoutConfig `json:"lockout"`
+    Revisions int `json:"revisions"`
+    TrashRetention int `json:"trash_retention"`
+    Log LogConfig `json:"log"`
+    Limits LimitConfig `json:"limits"`
+    Passwords PasswordConfig `json:"passwords"`
+}
+
+// Days a removed store stays in the trash before it is purged.
+func (cfg *VincaConfig) TrashLifetime() time.Duration {
+    if cfg.TrashRetention <= 0 {
+        return 30 * 24 * time.Hour
+    }
+    return time.Duration(cfg.TrashRetention) * 24 * time.Hour
+}
+
+// Number of previous versions kept for every store.
+func (cfg *VincaConfig) RevisionLimit() int {
+    if cfg.Revisions <= 0 {
+        return 20
+    }
+    return cfg.Revisions
+}
+
+// Failed logins above the threshold lock the account or address for
+// Delay seconds, doubled on every further failure up to MaxDelay.
+type LockoutConfig struct {
+    Threshold int `json:"threshold"`
+    Delay int `json:"delay"`
+    MaxDelay int `json:"max_delay"`
+}
+
+func (lc LockoutConfig) Attempts() int {
+    if lc.Threshold <= 0 {
+        return 5
+    }
+    return lc.Threshold
+}
+
+func (lc LockoutConfig) BaseDelay() time.Duration {
+    if lc.Delay <= 0 {
+        return 2 * time.Second
+    }
+    return time.Duration(lc.Delay) * time.Second
+}
+
+func (lc LockoutConfig) MaxBackoff() time.Duration {
+    if lc.MaxDelay <= 0 {
+        return 15 * time.Minute
+    }
+    return time.Duration(lc.MaxDelay) * time.Second
+}
+
+// Request size limits in bytes, Body applies to the raw request and
+// Content to encrypted blobs like store content and container keys.
+type LimitConfig struct {
+    Body int64 `json:"body"`
+    Content int `json:"content"`
+}
+
+func (lc LimitConfig) BodyLimit() int64 {
+    if lc.Body <= 0 {
+        return 16 << 20
+    }
+    return lc.Body
+}
+
+func (lc LimitConfig) ContentLimit() int {
+    if lc.Content <= 0 {
+        return 64 << 10
+    }
+    return lc.Content
+}
+
+type NotifierConfig struct {
+    Kind string `json:"kind"`
+    Path string `json:"path"`
+}
+
+func (cfg *VincaConfig) ResetLifetime() time.Duration {
+    if cfg.ResetTimeout <= 0 {
+        return time.Hour
+    }
+    return time.Duration(cfg.ResetTimeout) * time.Second
+}
+
+// Session timeouts are given in seconds, zero values fall back to defaults.
+type SessionConfig struct {
+    Storage string `json:"storage"`
+    IdleTimeout int `json:"idle_timeout"`
+    Lifetime int `json:"lifetime"`
+    ReapInterval int `json:"reap_interval"`
+}
+
+func (sc SessionConfig) Idle() time.Duration {
+    if sc.IdleTimeout <= 0 {
+        return 30 * time.Minute
+    }
+    return time.Duration(sc.IdleTimeout) * time.Second
+}
+
+func (sc SessionConfig) MaxLifetime() time.Duration {
+    if sc.Lifetime <= 0 {
+        return 24 * time.Hour
+    }
+    return time.Duration(sc.Lifetime) * time.Second
+}
+
+func (sc SessionConfig) Interval() time.Duration {
+    if sc.ReapInterval <= 0 {
+        return time.Minute
+    }
+    return time.Duration(sc.ReapInterval) * time.Second
 }
 
 func (cfg* VincaConfig) LoadConfig(file string) error {
     conf, err := os.Open(file)
     if err == os.ErrNotExist {
-        log.Println("Configuration file does not exist:", file)
+        slog.Warn("configuration file does not exist", "file", file)
         return nil
     } else if err != nil {
-        log.Fatal(err)
+        slog.Error("unable to open configuration", "file", file, "err", err)
         return err
     }
     defer conf.Close()
 
     if err = json.NewDecoder(conf).Decode(cfg); err != nil {
-        log.Fatal(err)
+        slog.Error("unable to decode configuration", "file", file, "err", err)
         return err
     }
     return nil
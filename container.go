@@ -1,38 +1,258 @@
 package main
 
-import "log"
+import "context"
+import "log/slog"
+import "database/sql"
+import "net/http"
+
+var ErrRotationIncomplete = NewHandlerErr("container_rotation_incomplete", http.StatusConflict)
 
 type Container struct {
     Id int `json:"id"`
     Name string `json:"name"`
     Certificate []byte `json:"certificate"`
     Encrypted []byte `json:"encrypted"`
+    Shared bool `json:"shared"`
+    Role string `json:"role,omitempty"`
+}
+
+type StoreRotation struct {
+    Id int `json:"id"`
+    Content []byte `json:"content"`
 }
 
-// Currently we support only a single container per user.
-func (v *VincaDatabase) FetchContainer(usr *User) Container {
-    row := v.db.QueryRow("select id, name, public, encrypted from containers where user_id = ? limit 1", usr.Id)
+// The default container is the oldest one created by the user.
+// Oldest container of the user, sql.ErrNoRows when the user has none.
+func (v *VincaDatabase) FetchDefaultContainer(ctx context.Context, usr *User) (Container, error) {
+    row := v.db.QueryRow("select id, name, public, encrypted from containers where user_id = ? order by id asc limit 1", usr.Id)
 
     var container = Container{}
     if err := row.Scan(&container.Id, &container.Name, &container.Certificate, &container.Encrypted); err != nil {
-        log.Println("unable to fetch user container:", err)
-        return Container{Id: -1}
+        if err != sql.ErrNoRows {
+            slog.ErrorContext(ctx, "unable to fetch user container", "err", err)
+        }
+        return container, err
+    }
+    return container, nil
+}
+
+func (v *VincaDatabase) FetchContainers(ctx context.Context, usr *User) ([]Container, error) {
+    rows, err := v.db.Query("select id, name, public, encrypted from containers where user_id = ? order by id asc", usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch containers", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var containers []Container
+    for rows.Next() {
+        var container = Container{}
+        if err = rows.Scan(&container.Id, &container.Name, &container.Certificate, &container.Encrypted); err != nil {
+            slog.ErrorContext(ctx, "unable to scan container", "err", err)
+            continue
+        }
+        containers = append(containers, container)
+    }
+    return containers, nil
+}
+
+func (v *VincaDatabase) FetchContainer(ctx context.Context, container *Container, usr *User) error {
+    err := v.db.QueryRow("select name, public, encrypted from containers where id = ? and user_id = ?",
+            container.Id, usr.Id).Scan(&container.Name, &container.Certificate, &container.Encrypted)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch container", "err", err)
+        return err
     }
-    return container
+    return nil
 }
 
-func (v *VincaDatabase) SaveContainer(container *Container, usr *User) error {
+func (v *VincaDatabase) SaveContainer(ctx context.Context, container *Container, usr *User) error {
     res, err := v.db.Exec("insert into containers(user_id, name, public, encrypted) values(?,?,?,?)",
             usr.Id, container.Name, container.Certificate, container.Encrypted)
     if err != nil {
-        log.Println("unable to save container:", err)
+        slog.ErrorContext(ctx, "unable to save container", "err", err)
         return err
     }
 
     if cid, err := res.LastInsertId(); err == nil {
         container.Id = int(cid)
     } else {
-        log.Println("unable to fetch insert id:", err)
+        slog.ErrorContext(ctx, "unable to fetch insert id", "err", err)
+    }
+    return nil
+}
+
+func (v *VincaDatabase) RenameContainer(ctx context.Context, container *Container, usr *User) error {
+    res, err := v.db.Exec("update containers set name = ?, modified = current_timestamp where id = ? and user_id = ?",
+            container.Name, container.Id, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to rename container", "err", err)
+        return err
+    }
+
+    rows, err := res.RowsAffected()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch affected rows", "err", err)
+        return nil
+    }
+
+    if rows != 1 {
+        slog.WarnContext(ctx, "container rename affected different row count", "affected", rows)
+    }
+    return nil
+}
+
+// Removes the container together with every store encrypted with its key.
+func (v *VincaDatabase) DestroyContainer(ctx context.Context, container *Container, usr *User) error {
+    tx, err := v.db.Begin()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to begin container removal", "err", err)
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err = tx.Exec("delete from store_revisions where store_id in (select id from stores where container_id = ? and user_id = ?)", container.Id, usr.Id); err != nil {
+        slog.ErrorContext(ctx, "unable to remove container store revisions", "err", err)
+        return err
+    }
+
+    _, err = tx.Exec("insert into tombstones(user_id, container_id, kind, object_id, deleted) select user_id, container_id, ?, id, current_timestamp from stores where container_id = ? and user_id = ?",
+            TombstoneStore, container.Id, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to save container store tombstones", "err", err)
+        return err
+    }
+
+    _, err = tx.Exec("insert into tombstones(user_id, container_id, kind, object_id, deleted) select user_id, container_id, ?, container_id, current_timestamp from container_members where container_id = ?",
+            TombstoneContainer, container.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to save member container tombstones", "err", err)
+        return err
+    }
+
+    _, err = tx.Exec("insert into tombstones(user_id, container_id, kind, object_id, deleted) values(?,?,?,?,current_timestamp)",
+            usr.Id, container.Id, TombstoneContainer, container.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to save container tombstone", "err", err)
+        return err
+    }
+
+    if _, err = tx.Exec("delete from stores where container_id = ? and user_id = ?", container.Id, usr.Id); err != nil {
+        slog.ErrorContext(ctx, "unable to remove container stores", "err", err)
+        return err
+    }
+
+    if _, err = tx.Exec("delete from container_members where container_id = ?", container.Id); err != nil {
+        slog.ErrorContext(ctx, "unable to remove container members", "err", err)
+        return err
+    }
+
+    if _, err = tx.Exec("delete from containers where id = ? and user_id = ?", container.Id, usr.Id); err != nil {
+        slog.ErrorContext(ctx, "unable to remove container", "err", err)
+        return err
+    }
+
+    if err = tx.Commit(); err != nil {
+        slog.ErrorContext(ctx, "unable to commit container removal", "err", err)
+        return err
+    }
+    return nil
+}
+
+// Replaces the container keys, the content of every store inside it and
+// the wrapped keys of all members in a single transaction. Any store or
+// member missing from the upload aborts the whole rotation, so the vault
+// never ends up with mixed keys.
+func (v *VincaDatabase) RotateContainer(ctx context.Context, container *Container, stores []StoreRotation, members []MemberKey, usr *User) error {
+    tx, err := v.db.Begin()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to begin container rotation", "err", err)
+        return err
+    }
+    defer tx.Rollback()
+
+    var seen = make(map[int]bool)
+    for _, st := range stores {
+        if seen[st.Id] {
+            return ErrRotationIncomplete
+        }
+        seen[st.Id] = true
+
+        res, err := tx.Exec("update stores set content = ?, version = version + 1, modified = current_timestamp where id = ? and container_id = ? and user_id = ?",
+                st.Content, st.Id, container.Id, usr.Id)
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to rotate store content", "err", err)
+            return err
+        }
+
+        if rows, err := res.RowsAffected(); err != nil || rows != 1 {
+            slog.WarnContext(ctx, "rotated store does not belong to container", "store", st.Id, "container", container.Id)
+            return ErrRotationIncomplete
+        }
+    }
+
+    // Revisions are encrypted with the previous key, restoring one would mix keys.
+    if _, err = tx.Exec("delete from store_revisions where store_id in (select id from stores where container_id = ? and user_id = ?)", container.Id, usr.Id); err != nil {
+        slog.ErrorContext(ctx, "unable to remove rotated store revisions", "err", err)
+        return err
+    }
+
+    var count int
+    if err = tx.QueryRow("select count(*) from stores where container_id = ? and user_id = ?", container.Id, usr.Id).Scan(&count); err != nil {
+        slog.ErrorContext(ctx, "unable to count container stores", "err", err)
+        return err
+    }
+
+    if count != len(stores) {
+        slog.WarnContext(ctx, "container rotation missing stores", "expected", count, "got", len(stores))
+        return ErrRotationIncomplete
+    }
+
+    var seenMembers = make(map[string]bool)
+    for _, mk := range members {
+        if seenMembers[mk.Email] {
+            return ErrRotationIncomplete
+        }
+        seenMembers[mk.Email] = true
+
+        res, err := tx.Exec("update container_members set encrypted = ?, modified = current_timestamp where container_id = ? and user_id = (select id from users where email = ?)",
+                mk.Encrypted, container.Id, mk.Email)
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to rotate member key", "err", err)
+            return err
+        }
+
+        if rows, err := res.RowsAffected(); err != nil || rows != 1 {
+            slog.WarnContext(ctx, "rotated member key for unknown member", "email", mk.Email)
+            return ErrRotationIncomplete
+        }
+    }
+
+    if err = tx.QueryRow("select count(*) from container_members where container_id = ?", container.Id).Scan(&count); err != nil {
+        slog.ErrorContext(ctx, "unable to count container members", "err", err)
+        return err
+    }
+
+    if count != len(members) {
+        slog.WarnContext(ctx, "container rotation missing member keys", "expected", count, "got", len(members))
+        return ErrRotationIncomplete
+    }
+
+    res, err := tx.Exec("update containers set public = ?, encrypted = ?, modified = current_timestamp where id = ? and user_id = ?",
+            container.Certificate, container.Encrypted, container.Id, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to rotate container keys", "err", err)
+        return err
+    }
+
+    if rows, err := res.RowsAffected(); err != nil || rows != 1 {
+        slog.WarnContext(ctx, "container rotation affected different row count", "affected", rows)
+        return ErrRotationIncomplete
+    }
+
+    if err = tx.Commit(); err != nil {
+        slog.ErrorContext(ctx, "unable to commit container rotation", "err", err)
+        return err
     }
     return nil
 }
@@ -1,41 +1,132 @@
 package main
 
+import "context"
 import "fmt"
-import "log"
+import "log/slog"
 import "time"
+import "strings"
 import "database/sql"
 import _ "github.com/go-sql-driver/mysql"
+import _ "github.com/mattn/go-sqlite3"
+
+const DriverMySQL = "mysql"
+const DriverSQLite = "sqlite"
+const DriverMemory = "memory"
 
 type VincaDatabase struct {
     db *sql.DB
+    driver string
 }
 
 type Datetime time.Time
 
+var datetimeLayouts = []string{
+    "2006-01-02 15:04:05",
+    "2006-01-02 15:04:05.999999999-07:00",
+    time.RFC3339Nano,
+}
+
 func (dt *Datetime) Scan(v interface{}) error {
-    if v == nil {
+    var str string
+    switch val := v.(type) {
+    case nil:
         *dt = Datetime(time.Unix(0, 0))
         return nil
+    case time.Time:
+        *dt = Datetime(val)
+        return nil
+    case []byte:
+        str = string(val)
+    case string:
+        str = val
+    default:
+        return fmt.Errorf("failed to scan Datetime")
     }
 
-    if arr, ok := v.([]byte); ok {
-        t, err := time.Parse("2006-01-02 15:04:05", string(arr))
-        if err == nil {
+    var err error
+    for _, layout := range datetimeLayouts {
+        var t time.Time
+        if t, err = time.Parse(layout, str); err == nil {
             *dt = Datetime(t)
             return nil
         }
-        return err
     }
-    return fmt.Errorf("failed to scan Datetime")
+    return err
+}
+
+func (dt Datetime) MarshalJSON() ([]byte, error) {
+    return time.Time(dt).MarshalJSON()
 }
 
+// Anything but a RFC 3339 string is ignored, the server owns these
+// timestamps and clients only echo them back.
+func (dt *Datetime) UnmarshalJSON(data []byte) error {
+    var t time.Time
+    if err := t.UnmarshalJSON(data); err == nil {
+        *dt = Datetime(t)
+    }
+    return nil
+}
+
+// Current time of the database clock, timestamps stored through
+// current_timestamp are only comparable with this one.
+func (vb *VincaDatabase) Now(ctx context.Context) (Datetime, error) {
+    var now Datetime
+    if err := vb.db.QueryRow("select current_timestamp").Scan(&now); err != nil {
+        slog.ErrorContext(ctx, "unable to fetch database time", "err", err)
+        return now, err
+    }
+    return now, nil
+}
+
+// Connects to the configured database and applies pending migrations.
 func (vb *VincaDatabase) Open() bool {
-    var err error
-    vb.db, err = sql.Open("mysql", vincaConfig.Database)
+    if err := vb.OpenWith(vincaConfig.Driver, vincaConfig.Database); err != nil {
+        slog.Error("Error occurred while database open", "err", err)
+        return false
+    }
 
-    if err != nil {
-        log.Println("Error occurred while database open:", err)
+    if err := vb.MigrateUp(); err != nil {
+        slog.Error("Error occurred while database migration", "err", err)
         return false
     }
     return true
-}
\ No newline at end of file
+}
+
+// Opens the storage backend, the memory driver is a private SQLite
+// database that is gone once the process exits.
+func (vb *VincaDatabase) OpenWith(driver, dsn string) error {
+    var err error
+
+    switch driver {
+    case "", DriverMySQL:
+        vb.driver = DriverMySQL
+        vb.db, err = sql.Open("mysql", dsn)
+        return err
+    case DriverSQLite:
+        var sep = "?"
+        if strings.Contains(dsn, "?") {
+            sep = "&"
+        }
+        vb.db, err = sql.Open("sqlite3", dsn + sep + "_foreign_keys=1&_busy_timeout=5000")
+    case DriverMemory:
+        vb.db, err = sql.Open("sqlite3", ":memory:")
+    default:
+        return fmt.Errorf("unknown database driver: %s", driver)
+    }
+
+    if err != nil {
+        return err
+    }
+    vb.driver = driver
+
+    // SQLite allows a single writer, and every connection to :memory:
+    // would open its own empty database.
+    vb.db.SetMaxOpenConns(1)
+    vb.db.SetConnMaxLifetime(0)
+    return nil
+}
+
+func (vb *VincaDatabase) Close() error {
+    return vb.db.Close()
+}
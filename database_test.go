@@ -0,0 +1,100 @@
+package main
+
+import "time"
+import "context"
+import "testing"
+import "path/filepath"
+
+func TestOpenSQLiteOptions(t *testing.T) {
+    dir := t.TempDir()
+    for _, dsn := range []string{
+        filepath.Join(dir, "plain.db"),
+        "file:" + filepath.Join(dir, "query.db") + "?mode=rwc",
+    } {
+        var database = &VincaDatabase{}
+        if err := database.OpenWith(DriverSQLite, dsn); err != nil {
+            t.Fatalf("%s: unable to open: %v", dsn, err)
+        }
+
+        var enabled int
+        if err := database.db.QueryRow("pragma foreign_keys").Scan(&enabled); err != nil {
+            t.Errorf("%s: unable to query foreign keys: %v", dsn, err)
+        } else if enabled != 1 {
+            t.Errorf("%s: foreign keys are not enforced", dsn)
+        }
+        database.Close()
+    }
+}
+
+func TestRemoveSession(t *testing.T) {
+    database := vincaRepository.(*VincaDatabase)
+    username := uniqueUsername("oscar")
+    var usr = &User{UserParam: UserParam{Username: username, Email: username + "@example.com", Password: testPassword(username)}}
+    if err := database.UserSave(context.Background(), usr); err != nil {
+        t.Fatal("unable to save user:", err)
+    }
+
+    for _, sc := range []SessionContainer{
+        NewMemorySessions(time.Hour, time.Hour),
+        &DatabaseSessions{db: database, idle: time.Hour, lifetime: time.Hour},
+    } {
+        suid := sc.CreateSession(context.Background(), usr, "127.0.0.1", "test")
+        for _, expected := range []int{1, 0} {
+            if removed := sc.RemoveSession(context.Background(), suid); removed != expected {
+                t.Errorf("%T: expected %d removed sessions, got %d", sc, expected, removed)
+            }
+        }
+    }
+}
+
+// Versions name the same schema on every driver, SQLite only skips the
+// versions folded into its initial schema.
+func TestMigrationVersions(t *testing.T) {
+    mysql, err := LoadMigrations(DriverMySQL)
+    if err != nil {
+        t.Fatal("unable to load mysql migrations:", err)
+    }
+    sqlite, err := LoadMigrations(DriverSQLite)
+    if err != nil {
+        t.Fatal("unable to load sqlite migrations:", err)
+    }
+
+    var versions = make(map[int]string)
+    for _, mg := range mysql {
+        versions[mg.Version] = mg.Name
+    }
+    for _, mg := range sqlite[1:] {
+        if versions[mg.Version] != mg.Name {
+            t.Errorf("sqlite migration %04d_%s has no mysql counterpart", mg.Version, mg.Name)
+        }
+    }
+    if last := len(sqlite) - 1; sqlite[last].Version != mysql[len(mysql) - 1].Version {
+        t.Errorf("latest sqlite version %d differs from mysql", sqlite[last].Version)
+    }
+}
+
+func TestMigrateDownUp(t *testing.T) {
+    var database = &VincaDatabase{}
+    if err := database.OpenWith(DriverSQLite, filepath.Join(t.TempDir(), "migrate.db")); err != nil {
+        t.Fatal("unable to open:", err)
+    }
+    defer database.Close()
+
+    for _, step := range []struct{ name string; run func() error; current int }{
+        {"up", database.MigrateUp, 10},
+        {"down", database.MigrateDown, 9},
+        {"up again", database.MigrateUp, 10},
+    } {
+        if err := step.run(); err != nil {
+            t.Fatalf("%s: %v", step.name, err)
+        }
+
+        status, err := database.MigrationStatus()
+        if err != nil {
+            t.Fatalf("%s: unable to fetch status: %v", step.name, err)
+        }
+        if status.Current != step.current || len(status.Pending) != 10 - step.current {
+            t.Errorf("%s: unexpected status %d with %d pending", step.name, status.Current, len(status.Pending))
+        }
+    }
+}
@@ -0,0 +1,178 @@
+package main
+
+import "context"
+import "log/slog"
+import "fmt"
+import "sync"
+import "time"
+import "net/http"
+import "encoding/json"
+import "github.com/google/uuid"
+
+const EventCreate = "create"
+const EventUpdate = "update"
+const EventDelete = "delete"
+
+const EventKindStore = "store"
+const EventKindCategory = "category"
+
+// Events only describe what changed, clients fetch the encrypted data
+// through the regular endpoints.
+type VaultEvent struct {
+    Kind string `json:"kind"`
+    Action string `json:"action"`
+    Id int `json:"id"`
+    Version int `json:"version,omitempty"`
+}
+
+type EventHub struct {
+    mu sync.RWMutex
+    subscribers map[int]map[chan VaultEvent]struct{}
+}
+
+// Streams end once their session is gone, the session is checked on
+// every heartbeat.
+type EventStream struct {
+    userid int
+    session uuid.UUID
+}
+
+// Interval of the keep alive comments and session checks.
+var eventHeartbeat = 30 * time.Second
+
+var vincaEvents = &EventHub{subscribers: make(map[int]map[chan VaultEvent]struct{})}
+
+func (hub *EventHub) Subscribe(userid int) chan VaultEvent {
+    ch := make(chan VaultEvent, 16)
+
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+
+    if hub.subscribers[userid] == nil {
+        hub.subscribers[userid] = make(map[chan VaultEvent]struct{})
+    }
+    hub.subscribers[userid][ch] = struct{}{}
+
+    return ch
+}
+
+func (hub *EventHub) Unsubscribe(userid int, ch chan VaultEvent) {
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+
+    delete(hub.subscribers[userid], ch)
+    if len(hub.subscribers[userid]) == 0 {
+        delete(hub.subscribers, userid)
+    }
+}
+
+// Slow subscribers never block the publisher, their events are dropped.
+func (hub *EventHub) Publish(userid int, ev VaultEvent) {
+    hub.mu.RLock()
+    defer hub.mu.RUnlock()
+
+    for ch := range hub.subscribers[userid] {
+        select {
+        case ch <- ev:
+        default:
+            slog.Warn("dropping event for slow subscriber", "user", userid)
+        }
+    }
+}
+
+// Publishes the event once to every listed user.
+func (hub *EventHub) PublishUsers(users []int, ev VaultEvent) {
+    var published = make(map[int]bool)
+    for _, userid := range users {
+        if !published[userid] {
+            published[userid] = true
+            hub.Publish(userid, ev)
+        }
+    }
+}
+
+// Category events reach the owner and every user reading a store of the
+// category, the same users that receive the category with a sync.
+func (hub *EventHub) PublishCategory(ctx context.Context, usr *User, ct *Category, action string) {
+    ev := VaultEvent{Kind: EventKindCategory, Action: action, Id: ct.Id, Version: ct.Version}
+    hub.PublishUsers(append(vincaRepository.FetchCategoryUsers(ctx, ct.Id), usr.Id), ev)
+}
+
+// Store events reach the owner and every member of the store container.
+func (hub *EventHub) PublishStore(ctx context.Context, st *Store, action string) {
+    ev := VaultEvent{Kind: EventKindStore, Action: action, Id: st.Id, Version: st.Version}
+    hub.PublishUsers(vincaRepository.FetchContainerUsers(ctx, st.Container), ev)
+}
+
+func (v *VincaDatabase) FetchContainerUsers(ctx context.Context, container int) []int {
+    return v.fetchUsers(ctx, "select user_id from containers where id = ? union select user_id from container_members where container_id = ?",
+            container, container)
+}
+
+func (v *VincaDatabase) FetchCategoryUsers(ctx context.Context, category int) []int {
+    return v.fetchUsers(ctx, "select user_id from categories where id = ? union select m.user_id from container_members m join containers c on c.id = m.container_id join stores s on s.container_id = c.id join categories ct on ct.id = s.category_id where s.category_id = ? and s.deleted_at is null and c.user_id = ct.user_id",
+            category, category)
+}
+
+func (v *VincaDatabase) fetchUsers(ctx context.Context, query string, args ...interface{}) []int {
+    rows, err := v.db.Query(query, args...)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch event users", "err", err)
+        return nil
+    }
+    defer rows.Close()
+
+    var users []int
+    for rows.Next() {
+        var userid int
+        if err = rows.Scan(&userid); err != nil {
+            slog.ErrorContext(ctx, "unable to scan event user", "err", err)
+            continue
+        }
+        users = append(users, userid)
+    }
+    return users
+}
+
+func (es EventStream) Stream(w http.ResponseWriter, r *Request) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "streaming not supported", http.StatusInternalServerError)
+        return
+    }
+
+    // Subscribed before the headers are sent, a client seeing the stream
+    // open must not miss events of its next request.
+    ch := vincaEvents.Subscribe(es.userid)
+    defer vincaEvents.Unsubscribe(es.userid, ch)
+
+    header := w.Header()
+    header.Set("Content-Type", "text/event-stream")
+    header.Set("Cache-Control", "no-cache")
+    header.Set("Connection", "keep-alive")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    heartbeat := time.NewTicker(eventHeartbeat)
+    defer heartbeat.Stop()
+
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case <-heartbeat.C:
+            if vincaSessions.SessionUser(r.Context(), es.session) == nil {
+                return
+            }
+            fmt.Fprint(w, ": ping\n\n")
+        case ev := <-ch:
+            data, err := json.Marshal(ev)
+            if err != nil {
+                slog.ErrorContext(r.Context(), "unable to encode event", "err", err)
+                continue
+            }
+            fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Kind, data)
+        }
+        flusher.Flush()
+    }
+}
@@ -1,57 +1,183 @@
 package main
 
-import "log"
+import "strings"
+import "database/sql"
 
 func init() {
     var route *VincaRoute
 
     route = vincaMux.NewRoute("/api/v1/home/container")
     route.Middleware(auth_middleware)
-    route.Handle(api_container_get, "GET")
-    route.Handle(api_container_create, "POST")
+    route.HandleAuth(api_container_get, "GET")
+    route.HandleAuth(api_container_create, "POST")
+    route.HandleAuth(api_container_rename, "PATCH")
+
+    route = vincaMux.NewRoute("/api/v1/home/containers")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_containers, "GET")
+
+    route = vincaMux.NewRoute("/api/v1/home/container/delete")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_container_remove, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/container/rotate")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_container_rotate, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/container/members")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_members, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/container/members/key")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_member_key, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/container/members/invite")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_member_invite, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/container/members/remove")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_member_remove, "POST")
 
     route = vincaMux.NewRoute("/api/v1/home/categories")
     route.Middleware(auth_middleware)
-    route.Handle(api_categories, "GET")
+    route.HandleAuth(api_categories, "GET")
 
     route = vincaMux.NewRoute("/api/v1/home/category")
     route.Middleware(auth_middleware)
-    route.Handle(api_category_create, "POST")
-    route.Handle(api_category_update, "PATCH")
-    route.Handle(api_category_get, "GET")
+    route.HandleAuth(api_category_create, "POST")
+    route.HandleAuth(api_category_update, "PATCH")
+    route.HandleAuth(api_category_get, "GET")
 
     route = vincaMux.NewRoute("/api/v1/home/category/delete")
     route.Middleware(auth_middleware)
-    route.Handle(api_category_remove, "POST")
+    route.HandleAuth(api_category_remove, "POST")
 
     route = vincaMux.NewRoute("/api/v1/home/stores")
     route.Middleware(auth_middleware)
-    route.Handle(api_stores, "POST")
+    route.HandleAuth(api_stores, "POST")
 
     route = vincaMux.NewRoute("/api/v1/home/store/create")
     route.Middleware(auth_middleware)
-    route.Handle(api_store_create, "POST")
+    route.HandleAuth(api_store_create, "POST")
 
     route = vincaMux.NewRoute("/api/v1/home/store")
     route.Middleware(auth_middleware)
-    route.Handle(api_store_content, "POST")
-    route.Handle(api_store_update, "PATCH")
+    route.HandleAuth(api_store_content, "POST")
+    route.HandleAuth(api_store_update, "PATCH")
 
     route = vincaMux.NewRoute("/api/v1/home/store/delete")
     route.Middleware(auth_middleware)
-    route.Handle(api_store_remove, "POST")
+    route.HandleAuth(api_store_remove, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/store/revisions")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_store_revisions, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/store/revisions/restore")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_store_revision_restore, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/trash")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_trash, "GET")
+
+    route = vincaMux.NewRoute("/api/v1/home/trash/restore")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_trash_restore, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/trash/purge")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_trash_purge, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/trash/empty")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_trash_empty, "POST")
 
     route = vincaMux.NewRoute("/api/v1/home/store/search")
     route.Middleware(auth_middleware)
-    route.Handle(api_store_search, "POST")
+    route.HandleAuth(api_store_search, "POST")
 
     route = vincaMux.NewRoute("/api/v1/home/preferences")
     route.Middleware(auth_middleware)
-    route.Handle(api_user_update, "POST")
+    route.HandleAuth(api_user_update, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/export")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_vault_export, "GET")
+
+    route = vincaMux.NewRoute("/api/v1/home/import")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_vault_import, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/import/parse")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_import_parse, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/import/commit")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_import_commit, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/home/events")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_events, "GET")
 
     route = vincaMux.NewRoute("/api/v1/home")
     route.Middleware(auth_middleware)
-    route.Handle(api_home, "GET")
+    route.HandleAuth(api_home, "GET")
+
+    // Resource routes addressing ids in the path, the routes above
+    // remain as aliases for older clients.
+    route = vincaMux.NewRoute("/api/v1/containers")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_containers, "GET")
+    route.HandleAuth(api_container_create, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/containers/{id}")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_container_get, "GET")
+    route.HandleAuth(api_container_rename, "PATCH")
+    route.HandleAuth(api_container_remove, "DELETE")
+
+    route = vincaMux.NewRoute("/api/v1/categories")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_categories, "GET")
+    route.HandleAuth(api_category_create, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/categories/{id}")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_category_get, "GET")
+    route.HandleAuth(api_category_update, "PATCH")
+    route.HandleAuth(api_category_remove, "DELETE")
+
+    route = vincaMux.NewRoute("/api/v1/stores")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_stores, "GET")
+    route.HandleAuth(api_store_create, "POST")
+
+    route = vincaMux.NewRoute("/api/v1/stores/{id}")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_store_content, "GET")
+    route.HandleAuth(api_store_update, "PATCH")
+    route.HandleAuth(api_store_remove, "DELETE")
+
+    route = vincaMux.NewRoute("/api/v1/stores/{id}/revisions")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_store_revisions, "GET")
+
+    route = vincaMux.NewRoute("/api/v1/trash")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_trash, "GET")
+    route.HandleAuth(api_trash_empty, "DELETE")
+
+    route = vincaMux.NewRoute("/api/v1/trash/{id}")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_trash_purge, "DELETE")
+
+    route = vincaMux.NewRoute("/api/v1/trash/{id}/restore")
+    route.Middleware(auth_middleware)
+    route.HandleAuth(api_trash_restore, "POST")
 }
 
 type ContainerResponse struct {
@@ -60,14 +186,70 @@ type ContainerResponse struct {
 }
 
 type ContainerRequest struct {
+    Name string `json:"name"`
+    Encrypted []byte `json:"encrypted"`
+    Certificate []byte `json:"certificate"`
+}
+
+type ContainerRotateRequest struct {
+    Id int `json:"id"`
     Encrypted []byte `json:"encrypted"`
     Certificate []byte `json:"certificate"`
+    Stores []StoreRotation `json:"stores"`
+    Members []MemberKey `json:"members"`
+}
+
+type MemberRequest struct {
+    Container int `json:"container"`
+    Email string `json:"email"`
+    Role string `json:"role,omitempty"`
+    Encrypted []byte `json:"encrypted,omitempty"`
+}
+
+type MembersResponse struct {
+    Members []ContainerMember `json:"members"`
+}
+
+type MemberKeyResponse struct {
+    Email string `json:"email"`
+    Certificate []byte `json:"certificate"`
+}
+
+type ContainersResponse struct {
+    Containers []Container `json:"containers"`
 }
 
 type StoreContentRequest struct {
     StoreId int `json:"store_id"`
 }
 
+type RevisionRequest struct {
+    StoreId int `json:"store_id"`
+    Revision int `json:"revision"`
+}
+
+type RevisionsResponse struct {
+    Revisions []StoreRevision `json:"revisions"`
+}
+
+type TrashResponse struct {
+    Stores []TrashedStore `json:"stores"`
+}
+
+type TrashEmptyResponse struct {
+    Purged int `json:"purged"`
+}
+
+type ImportParseRequest struct {
+    Format string `json:"format"`
+    Data string `json:"data"`
+}
+
+type ImportCommitRequest struct {
+    Container int `json:"container"`
+    Entries []ImportStore `json:"entries"`
+}
+
 type StoreResponse struct {
     Stores []Store `json:"stores"`
 }
@@ -85,10 +267,12 @@ type CategoryDestroyResponse struct {
 type CategoryRequest struct {
     Category int `json:"category"`
     Global int `json:"global,omitempty"`
+    Container int `json:"container,omitempty"`
 }
 
 type StoresRequest struct {
     Category int `json:"category"`
+    Container int `json:"container,omitempty"`
 }
 
 type HomeResponse struct {
@@ -101,130 +285,349 @@ type UserUpdateRequest struct {
     UserParam
 }
 
-func api_container_get(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
+func api_container_get(r *Request, usr *User) interface{} {
+    var container = Container{}
+    if r.Param("id") == "" {
+        var err error
+        if container, err = vincaRepository.FetchDefaultContainer(r.Context(), usr); err != nil {
+            return err
+        }
+    } else {
+        if err := r.DecodeResource(&container, &container.Id); err != nil {
+            return err
+        }
+
+        if err := vincaRepository.FetchContainer(r.Context(), &container, usr); err == sql.ErrNoRows {
+            if err := vincaRepository.FetchSharedContainer(r.Context(), &container, usr); err != nil {
+                return err
+            }
+        } else if err != nil {
+            return err
+        }
+    }
+
+    categories, err := vincaRepository.FetchContainerCategories(r.Context(), &container, usr)
+    if err != nil {
+        return err
     }
 
     return ContainerResponse{
-        Container: vincaDatabase.FetchContainer(usr),
-        Categories: vincaDatabase.FetchCategories(usr),
+        Container: container,
+        Categories: categories,
     }
 }
 
-func api_container_create(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
-    }
-
+func api_container_create(r *Request, usr *User) interface{} {
     var req = ContainerRequest{}
     if err := r.Decode(&req); err != nil {
         return err
     }
 
     var container = &Container{
-        Name: "Default",
+        Name: req.Name,
         Certificate: req.Certificate,
         Encrypted: req.Encrypted,
     }
+    if container.Name == "" {
+        container.Name = "Default"
+    }
 
-    if err := vincaDatabase.SaveContainer(container, usr); err != nil {
-        log.Println("unable to save container:", err)
-        return nil
+    if err := vincaRepository.SaveContainer(r.Context(), container, usr); err != nil {
+        return err
     }
+
+    categories, err := vincaRepository.FetchCategories(r.Context(), usr)
+    if err != nil {
+        return err
+    }
+
     return ContainerResponse{
         Container: *container,
-        Categories: vincaDatabase.FetchCategories(usr),
+        Categories: categories,
     }
 }
 
-func api_categories(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
+func api_containers(r *Request, usr *User) interface{} {
+    containers, err := vincaRepository.FetchContainers(r.Context(), usr)
+    if err != nil {
+        return err
     }
 
-    return vincaDatabase.FetchCategories(usr)
+    shared, err := vincaRepository.FetchSharedContainers(r.Context(), usr)
+    if err != nil {
+        return err
+    }
+
+    return ContainersResponse{
+        Containers: append(containers, shared...),
+    }
 }
 
-func api_category_get(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
+func api_container_rename(r *Request, usr *User) interface{} {
+    var req = Container{}
+    if err := r.DecodeResource(&req, &req.Id); err != nil {
+        return err
     }
 
-    var param = CategoryRequest{}
-    if err := r.Decode(&param); err != nil {
+    if req.Name == "" {
+        return ErrInvalidParams
+    }
+
+    var container = Container{Id: req.Id}
+    if err := vincaRepository.FetchOwnedContainer(r.Context(), &container, usr); err != nil {
+        return err
+    }
+
+    container.Name = req.Name
+    if err := vincaRepository.RenameContainer(r.Context(), &container, usr); err != nil {
+        return err
+    }
+    return container
+}
+
+func api_container_remove(r *Request, usr *User) interface{} {
+    var container = Container{}
+    if err := r.DecodeResource(&container, &container.Id); err != nil {
+        return err
+    }
+
+    if err := vincaRepository.FetchOwnedContainer(r.Context(), &container, usr); err != nil {
+        return err
+    }
+
+    if err := vincaRepository.DestroyContainer(r.Context(), &container, usr); err != nil {
+        return err
+    }
+    return container
+}
+
+func api_container_rotate(r *Request, usr *User) interface{} {
+    var req = ContainerRotateRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    if len(req.Certificate) == 0 || len(req.Encrypted) == 0 {
+        return ErrInvalidParams
+    }
+
+    var container = Container{Id: req.Id}
+    if err := vincaRepository.FetchOwnedContainer(r.Context(), &container, usr); err != nil {
+        return err
+    }
+
+    container.Certificate = req.Certificate
+    container.Encrypted = req.Encrypted
+    if err := vincaRepository.RotateContainer(r.Context(), &container, req.Stores, req.Members, usr); err != nil {
+        return err
+    }
+
+    for _, st := range req.Stores {
+        vincaEvents.PublishStore(r.Context(), &Store{Id: st.Id, StoreParam: StoreParam{Container: container.Id}}, EventUpdate)
+    }
+    return container
+}
+
+func api_members(r *Request, usr *User) interface{} {
+    var req = MemberRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    var container = Container{Id: req.Container}
+    if err := vincaRepository.FetchOwnedContainer(r.Context(), &container, usr); err != nil {
+        return err
+    }
+
+    members, err := vincaRepository.FetchMembers(r.Context(), &container)
+    if err != nil {
+        return err
+    }
+
+    return MembersResponse{
+        Members: members,
+    }
+}
+
+// Public certificate of the invited user, used by the owner to wrap
+// the container key for the new member.
+// Only the owner of the container may look up the key of an invitee,
+// unknown emails and users without a key are answered alike so the
+// route does not reveal which emails are registered.
+func api_member_key(r *Request, usr *User) interface{} {
+    var req = MemberRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    var owned = Container{Id: req.Container}
+    if err := vincaRepository.FetchOwnedContainer(r.Context(), &owned, usr); err != nil {
+        return err
+    }
+
+    member := vincaRepository.FetchUser(r.Context(), req.Email)
+    if member == nil || member.Id == usr.Id {
+        return ErrInvalidMember
+    }
+
+    container, err := vincaRepository.FetchDefaultContainer(r.Context(), member)
+    if err == sql.ErrNoRows {
+        return ErrInvalidMember
+    } else if err != nil {
+        return err
+    }
+    return MemberKeyResponse{Email: member.Email, Certificate: container.Certificate}
+}
+
+func api_member_invite(r *Request, usr *User) interface{} {
+    var req = MemberRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    if !ValidMemberRole(req.Role) || len(req.Encrypted) == 0 {
+        return ErrInvalidParams
+    }
+
+    var container = Container{Id: req.Container}
+    if err := vincaRepository.FetchOwnedContainer(r.Context(), &container, usr); err != nil {
+        return err
+    }
+
+    invited := vincaRepository.FetchUser(r.Context(), req.Email)
+    if invited == nil || invited.Id == usr.Id {
+        return ErrInvalidMember
+    }
+
+    var member = ContainerMember{
+        Username: invited.Username,
+        Email: invited.Email,
+        Role: req.Role,
+        Encrypted: req.Encrypted,
+        userid: invited.Id,
+    }
+    if err := vincaRepository.SaveMember(r.Context(), &container, &member); err != nil {
+        return err
+    }
+    return member
+}
+
+func api_member_remove(r *Request, usr *User) interface{} {
+    var req = MemberRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    var container = Container{Id: req.Container}
+    if err := vincaRepository.FetchOwnedContainer(r.Context(), &container, usr); err != nil {
         return err
     }
 
-    return vincaDatabase.FetchStoresWith(usr, &param)
+    removed := vincaRepository.FetchUser(r.Context(), req.Email)
+    if removed == nil {
+        return ErrInvalidMember
+    }
+
+    var member = ContainerMember{Username: removed.Username, Email: removed.Email, userid: removed.Id}
+    if err := vincaRepository.DestroyMember(r.Context(), &container, &member); err != nil {
+        return err
+    }
+    return member
+}
+
+func api_categories(r *Request, usr *User) interface{} {
+    categories, err := vincaRepository.FetchCategories(r.Context(), usr)
+    if err != nil {
+        return err
+    }
+    return categories
 }
 
-func api_category_create(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
+func api_category_get(r *Request, usr *User) interface{} {
+    var param = CategoryRequest{}
+    if err := r.DecodeResource(&param, &param.Category); err != nil {
+        return err
     }
 
+    stores, err := vincaRepository.FetchStoresWith(r.Context(), usr, &param)
+    if err != nil {
+        return err
+    }
+    return stores
+}
+
+func api_category_create(r *Request, usr *User) interface{} {
     var category = Category{}
     if err := r.Decode(&category.CategoryParams); err != nil {
         return err
     }
 
-    if err := vincaDatabase.SaveCategory(&category, usr); err != nil {
-        log.Println("unable to save category to database:", err)
-        return nil
+    if err := vincaRepository.SaveCategory(r.Context(), &category, usr); err != nil {
+        return err
+    }
+    vincaEvents.PublishCategory(r.Context(), usr, &category, EventCreate)
+
+    categories, err := vincaRepository.FetchCategories(r.Context(), usr)
+    if err != nil {
+        return err
     }
 
     return CategoryResponse{Created: &category,
-        Categories: vincaDatabase.FetchCategories(usr),
+        Categories: categories,
     }
 }
 
-func api_category_update(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
+func api_category_update(r *Request, usr *User) interface{} {
+    var category = Category{}
+    if err := r.DecodeResource(&category, &category.Id); err != nil {
+        return err
     }
 
-    var category = Category{}
-    if err := r.Decode(&category); err != nil {
+    version, err := r.ExpectedVersion(category.Version)
+    if err != nil {
         return err
     }
+    category.Version = version
 
-    if err := vincaDatabase.UpdateCategory(&category, usr); err != nil {
+    if err := vincaRepository.UpdateCategory(r.Context(), &category, usr); err == ErrStaleWrite {
+        var current = Category{Id: category.Id}
+        if err := vincaRepository.FetchCategory(r.Context(), &current, usr); err != nil {
+            return err
+        }
+        return ErrStaleWrite.WithContent(current)
+    } else if err != nil {
         return err
     }
+    vincaEvents.PublishCategory(r.Context(), usr, &category, EventUpdate)
+
     return category
 }
 
-func api_category_remove(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
-    }
-
+func api_category_remove(r *Request, usr *User) interface{} {
     var req = CategoryDestroyRequest{}
-    if err := r.Decode(&req); err != nil {
+    if err := r.DecodeResource(&req, &req.Id); err != nil {
         return err
     }
 
     var category = Category{Id: req.Id}
-    if err := vincaDatabase.FetchCategory(&category, usr); err != nil {
+    if err := vincaRepository.FetchCategory(r.Context(), &category, usr); err != nil {
         return err
     }
 
+    // Readers of the category lose the link to it once its stores are
+    // migrated, they are collected beforehand.
+    users := vincaRepository.FetchCategoryUsers(r.Context(), category.Id)
+
     var migrate = Category{Id: req.Migrate}
-    if err := vincaDatabase.MigrateCategory(&category, &migrate, usr); err != nil {
+    if err := vincaRepository.MigrateCategory(r.Context(), &category, &migrate, usr); err != nil {
         return err
     }
 
-    if err := vincaDatabase.DestroyCategory(&category, usr); err != nil {
+    if err := vincaRepository.DestroyCategory(r.Context(), &category, usr); err != nil {
         return err
     }
+    vincaEvents.PublishUsers(append(users, usr.Id),
+            VaultEvent{Kind: EventKindCategory, Action: EventDelete, Id: category.Id, Version: category.Version})
 
     return CategoryDestroyResponse{
         Removed: category,
@@ -232,155 +635,372 @@ func api_category_remove(r *Request) interface{} {
     }
 }
 
-func api_stores(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
+func api_stores(r *Request, usr *User) interface{} {
+    var params = StoresRequest{}
+    if r.Method == "GET" {
+        params.Category = r.QueryInt("category")
+        params.Container = r.QueryInt("container")
+    } else if err := r.Decode(&params); err != nil {
+        return err
     }
 
-    var params = StoresRequest{}
-    if err := r.Decode(&params); err != nil {
+    stores, err := vincaRepository.FetchStores(r.Context(), usr, params)
+    if err != nil {
         return err
     }
 
     return StoreResponse{
-        Stores: vincaDatabase.FetchStores(usr, params),
+        Stores: stores,
     }
 }
 
-func api_store_content(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
-    }
-
+func api_store_content(r *Request, usr *User) interface{} {
     var param = StoreContentRequest{}
-    if err := r.Decode(&param); err != nil {
+    if err := r.DecodeResource(&param, &param.StoreId); err != nil {
         return err
     }
 
     var localStore = Store{Id: param.StoreId}
-    if err := vincaDatabase.FetchStoreContent(usr, &localStore); err != nil {
-        log.Println("unable to fetch store:", err)
-        return nil
+    if err := vincaRepository.FetchStoreContent(r.Context(), usr, &localStore); err != nil {
+        return err
     }
     return localStore
 }
 
-func api_store_create(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
-    }
-
+func api_store_create(r *Request, usr *User) interface{} {
     var store = Store{}
     if err := r.Decode(&store.StoreParam); err != nil {
         return err
     }
 
-    if err := vincaDatabase.SaveStore(usr, &store); err != nil {
-        log.Println("unable to save store to database.")
-        return nil
+    if store.Container == 0 {
+        container, err := vincaRepository.FetchDefaultContainer(r.Context(), usr)
+        if err != nil {
+            return err
+        }
+        store.Container = container.Id
+    }
+
+    var container = Container{Id: store.Container}
+    if err := vincaRepository.FetchContainer(r.Context(), &container, usr); err != nil {
+        if err := vincaRepository.FetchSharedContainer(r.Context(), &container, usr); err != nil {
+            return err
+        }
+
+        if container.Role != MemberWrite {
+            return ErrContainerReadOnly
+        }
     }
-    return store
-}
 
-func api_store_update(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
+    if err := vincaRepository.CheckStoreCategory(r.Context(), &store); err != nil {
+        return err
+    }
+
+    if err := vincaRepository.SaveStore(r.Context(), usr, &store); err != nil {
+        return err
     }
+    vincaEvents.PublishStore(r.Context(), &store, EventCreate)
+    return store
+}
 
+func api_store_update(r *Request, usr *User) interface{} {
     var store = Store{}
-    if err := r.Decode(&store); err != nil {
+    if err := r.DecodeResource(&store, &store.Id); err != nil {
         return err
     }
 
     var dbStore = Store{Id: store.Id}
-    if err := vincaDatabase.FetchStoreContent(usr, &dbStore); err != nil {
-        log.Println("unable to fetch store state:", err)
-        return nil
+    if err := vincaRepository.FetchStoreContent(r.Context(), usr, &dbStore); err != nil {
+        return err
+    }
+
+    if !vincaRepository.StoreWritable(r.Context(), usr, &dbStore) {
+        return ErrContainerReadOnly
+    }
+
+    version, err := r.ExpectedVersion(store.Version)
+    if err != nil {
+        return err
     }
+    store.Version = version
 
     if store.Content == nil {
         store.Content = dbStore.Content
     }
 
-    if err := vincaDatabase.UpdateStore(usr, &store); err != nil {
-        log.Println("unable to update store:", err)
-        return nil
+    store.Container = dbStore.Container
+    if err := vincaRepository.CheckStoreCategory(r.Context(), &store); err != nil {
+        return err
+    }
+
+    if err := vincaRepository.UpdateStore(r.Context(), usr, &store); err == ErrStaleWrite {
+        var current = Store{Id: store.Id}
+        if err := vincaRepository.FetchStoreContent(r.Context(), usr, &current); err != nil {
+            return err
+        }
+        return ErrStaleWrite.WithContent(current)
+    } else if err != nil {
+        return err
     }
+    vincaEvents.PublishStore(r.Context(), &store, EventUpdate)
+
     return store
 }
 
-func api_store_remove(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
+func api_store_remove(r *Request, usr *User) interface{} {
+    var ref = StoreReference{}
+    if err := r.DecodeResource(&ref, &ref.Id); err != nil {
+        return err
     }
 
-    var store = Store{}
-    if err := r.Decode(&store); err != nil {
+    var store = ref.Store
+
+    if err := vincaRepository.FetchStoreContent(r.Context(), usr, &store); err != nil {
+        return err
+    }
+
+    if !vincaRepository.StoreWritable(r.Context(), usr, &store) {
+        return ErrContainerReadOnly
+    }
+
+    if err := vincaRepository.DestroyStore(r.Context(), usr, &store); err != nil {
+        return err
+    }
+    vincaEvents.PublishStore(r.Context(), &store, EventDelete)
+    return store
+}
+
+func api_store_revisions(r *Request, usr *User) interface{} {
+    var req = RevisionRequest{}
+    if err := r.DecodeResource(&req, &req.StoreId); err != nil {
+        return err
+    }
+
+    revisions, err := vincaRepository.FetchStoreRevisions(r.Context(), usr, &Store{Id: req.StoreId})
+    if err != nil {
         return err
     }
 
-    if err := vincaDatabase.FetchStoreContent(usr, &store); err != nil {
-        log.Println("unable to fetch removed store:", err)
+    return RevisionsResponse{
+        Revisions: revisions,
+    }
+}
+
+func api_store_revision_restore(r *Request, usr *User) interface{} {
+    var req = RevisionRequest{}
+    if err := r.Decode(&req); err != nil {
         return err
     }
 
-    if err := vincaDatabase.DestroyStore(usr, &store); err != nil {
-        log.Println("unable to remove store:", err)
+    var store = Store{Id: req.StoreId}
+    if err := vincaRepository.FetchStoreContent(r.Context(), usr, &store); err != nil {
         return err
     }
+
+    if !vincaRepository.StoreWritable(r.Context(), usr, &store) {
+        return ErrContainerReadOnly
+    }
+
+    var rev = StoreRevision{Id: req.Revision, StoreId: req.StoreId}
+    if err := vincaRepository.FetchStoreRevision(r.Context(), usr, &rev); err != nil {
+        return err
+    }
+
+    store.Name = rev.Name
+    store.Description = rev.Description
+    store.Icon = rev.Icon
+    store.Color = rev.Color
+    store.Content = rev.Content
+    if err := vincaRepository.UpdateStore(r.Context(), usr, &store); err != nil {
+        return err
+    }
+    vincaEvents.PublishStore(r.Context(), &store, EventUpdate)
     return store
 }
 
-func api_home(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
+func api_trash(r *Request, usr *User) interface{} {
+    stores, err := vincaRepository.FetchTrash(r.Context(), usr)
+    if err != nil {
+        return err
     }
 
-    return HomeResponse{
-        Unassigned: vincaDatabase.FetchStores(usr, StoresRequest{Category: 0}),
-        History: vincaDatabase.FetchStoreHistory(usr),
+    return TrashResponse{
+        Stores: stores,
+    }
+}
+
+func api_trash_restore(r *Request, usr *User) interface{} {
+    var ref = StoreReference{}
+    if err := r.DecodeResource(&ref, &ref.Id); err != nil {
+        return err
+    }
+
+    var store = ref.Store
+
+    if err := vincaRepository.RestoreStore(r.Context(), usr, &store); err != nil {
+        return err
+    }
+
+    if err := vincaRepository.FetchStoreContent(r.Context(), usr, &store); err != nil {
+        return err
+    }
+    vincaEvents.PublishStore(r.Context(), &store, EventCreate)
+
+    return store
+}
+
+func api_trash_purge(r *Request, usr *User) interface{} {
+    var ref = StoreReference{}
+    if err := r.DecodeResource(&ref, &ref.Id); err != nil {
+        return err
+    }
+
+    var store = ref.Store
+
+    if err := vincaRepository.PurgeStore(r.Context(), usr, &store); err != nil {
+        return err
+    }
+    return store
+}
+
+func api_trash_empty(r *Request, usr *User) interface{} {
+    purged, err := vincaRepository.EmptyTrash(r.Context(), usr)
+    if err != nil {
+        return err
+    }
+
+    return TrashEmptyResponse{
+        Purged: purged,
+    }
+}
+
+func api_vault_export(r *Request, usr *User) interface{} {
+    export, err := vincaRepository.ExportVault(r.Context(), usr)
+    if err != nil {
+        return err
     }
+    return export
 }
 
-func api_user_update(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
+func api_vault_import(r *Request, usr *User) interface{} {
+    var export = VaultExport{}
+    if err := r.Decode(&export); err != nil {
+        return err
+    }
+
+    result, err := vincaRepository.ImportVault(r.Context(), usr, &export)
+    if err != nil {
+        return err
     }
 
+    for i := range result.categories {
+        vincaEvents.PublishCategory(r.Context(), usr, &result.categories[i], EventCreate)
+    }
+    for i := range result.stores {
+        vincaEvents.PublishStore(r.Context(), &result.stores[i], EventCreate)
+    }
+    return result
+}
+
+func api_import_parse(r *Request, usr *User) interface{} {
+    var req = ImportParseRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    result, err := ParseImport(r.Context(), req.Format, strings.NewReader(req.Data))
+    if err != nil {
+        return err
+    }
+    names, err := vincaRepository.FetchStoreNames(r.Context(), usr)
+    if err != nil {
+        return err
+    }
+    result.MarkDuplicates(names)
+
+    return result
+}
+
+func api_import_commit(r *Request, usr *User) interface{} {
+    var req = ImportCommitRequest{}
+    if err := r.Decode(&req); err != nil {
+        return err
+    }
+
+    var container = Container{Id: req.Container}
+    if err := vincaRepository.FetchOwnedContainer(r.Context(), &container, usr); err != nil {
+        return err
+    }
+
+    result, err := vincaRepository.ImportStores(r.Context(), usr, &container, req.Entries)
+    if err != nil {
+        return err
+    }
+
+    for i := range result.Categories {
+        vincaEvents.PublishCategory(r.Context(), usr, result.Categories[i], EventCreate)
+    }
+    for i := range result.Stores {
+        vincaEvents.PublishStore(r.Context(), &result.Stores[i], EventCreate)
+    }
+    return result
+}
+
+func api_events(r *Request, usr *User) interface{} {
+    return EventStream{userid: usr.Id, session: r.SessionId()}
+}
+
+func api_home(r *Request, usr *User) interface{} {
+    unassigned, err := vincaRepository.FetchStores(r.Context(), usr, StoresRequest{Category: 0})
+    if err != nil {
+        return err
+    }
+
+    history, err := vincaRepository.FetchStoreHistory(r.Context(), usr)
+    if err != nil {
+        return err
+    }
+
+    return HomeResponse{
+        Unassigned: unassigned,
+        History: history,
+    }
+}
+
+func api_user_update(r *Request, usr *User) interface{} {
     var params = UserUpdateRequest{}
     if err := r.Decode(&params); err != nil {
         return err
     }
 
-    if !usr.Authenticate(params.Confirmation) {
+    if !usr.Authenticate(r.Context(), params.Confirmation) {
         return ErrInvalidPassword
     }
 
-    if err := vincaDatabase.UpdateUser(usr, params.UserParam); err != nil {
+    if err := vincaRepository.UpdateUser(r.Context(), usr, params.UserParam); err != nil {
         return err
     }
-    return usr
-}
 
-func api_store_search(r *Request) interface{} {
-    usr, ok := r.Value(AuthSessionUser).(*User)
-    if !ok {
-        return nil
+    if params.Password != "" {
+        suid := r.SessionId()
+        removed := vincaSessions.RemoveUserSessions(r.Context(), usr.Id, suid)
+        r.Logger().Info("password changed, revoked sessions", "user", usr, "removed", removed)
     }
+    return usr
+}
 
+func api_store_search(r *Request, usr *User) interface{} {
     var params = StoreQuery{}
     if err := r.Decode(&params); err != nil {
         return err
     }
 
+    stores, err := vincaRepository.FetchStoreQuery(r.Context(), usr, params)
+    if err != nil {
+        return err
+    }
+
     return StoreResponse{
-        Stores: vincaDatabase.FetchStoreQuery(usr, params),
+        Stores: stores,
     }
 }
\ No newline at end of file
@@ -0,0 +1,394 @@
+package main
+
+import "context"
+import "io"
+import "log/slog"
+import "strings"
+import "net/http"
+import "encoding/csv"
+import "encoding/json"
+
+const ImportBitwarden = "bitwarden"
+const ImportCSV = "csv"
+
+var ErrUnsupportedImport = NewHandlerErr("import_format_unsupported", http.StatusBadRequest)
+var ErrInvalidImport = NewHandlerErr("import_data_invalid", http.StatusBadRequest)
+
+// Clear text secrets of an imported entry. These are handed back to the
+// client for encryption and are never stored by the server.
+type ImportFields struct {
+    Username string `json:"username,omitempty"`
+    Password string `json:"password,omitempty"`
+    Url string `json:"url,omitempty"`
+    Notes string `json:"notes,omitempty"`
+    Totp string `json:"totp,omitempty"`
+}
+
+type ImportEntry struct {
+    Row int `json:"row"`
+    Category string `json:"category"`
+    Name string `json:"name"`
+    Description string `json:"description"`
+    Fields ImportFields `json:"fields"`
+    Duplicate bool `json:"duplicate"`
+}
+
+type ImportFailure struct {
+    Row int `json:"row"`
+    Reason string `json:"reason"`
+}
+
+type ImportResult struct {
+    Categories []string `json:"categories"`
+    Entries []ImportEntry `json:"entries"`
+    Failed []ImportFailure `json:"failed"`
+}
+
+// Rows uploaded after the client encrypted the parsed fields.
+type ImportStore struct {
+    Row int `json:"row"`
+    Category string `json:"category"`
+    Name string `json:"name"`
+    Description string `json:"description"`
+    Icon int `json:"icon"`
+    Color int `json:"color"`
+    Content []byte `json:"content"`
+}
+
+type ImportCommitResult struct {
+    Categories []*Category `json:"categories"`
+    Stores []Store `json:"stores"`
+    Failed []ImportFailure `json:"failed"`
+}
+
+type bitwardenExport struct {
+    Encrypted bool `json:"encrypted"`
+    Folders []struct {
+        Id string `json:"id"`
+        Name string `json:"name"`
+    } `json:"folders"`
+    Items []struct {
+        Type int `json:"type"`
+        Name string `json:"name"`
+        Notes string `json:"notes"`
+        FolderId string `json:"folderId"`
+        Login *struct {
+            Username string `json:"username"`
+            Password string `json:"password"`
+            Totp string `json:"totp"`
+            Uris []struct {
+                Uri string `json:"uri"`
+            } `json:"uris"`
+        } `json:"login"`
+    } `json:"items"`
+}
+
+// Header aliases of the CSV exports from KeePass, KeePassXC and Chrome.
+var csvColumns = map[string]string{
+    "title": "name",
+    "name": "name",
+    "account": "name",
+    "username": "username",
+    "user name": "username",
+    "login": "username",
+    "login name": "username",
+    "password": "password",
+    "url": "url",
+    "web site": "url",
+    "website": "url",
+    "notes": "notes",
+    "note": "notes",
+    "comments": "notes",
+    "group": "category",
+    "folder": "category",
+    "grouping": "category",
+    "totp": "totp",
+}
+
+func NewImportResult() *ImportResult {
+    return &ImportResult{Categories: []string{}, Entries: []ImportEntry{}, Failed: []ImportFailure{}}
+}
+
+func ParseImport(ctx context.Context, format string, r io.Reader) (*ImportResult, error) {
+    switch format {
+    case ImportBitwarden:
+        return ParseBitwardenJSON(ctx, r)
+    case ImportCSV:
+        return ParseCSV(ctx, r)
+    }
+    return nil, ErrUnsupportedImport
+}
+
+// Parses an unencrypted Bitwarden JSON export, only login and secure note
+// items are supported.
+func ParseBitwardenJSON(ctx context.Context, r io.Reader) (*ImportResult, error) {
+    var export = bitwardenExport{}
+    if err := json.NewDecoder(r).Decode(&export); err != nil {
+        slog.ErrorContext(ctx, "unable to decode bitwarden export", "err", err)
+        return nil, ErrInvalidImport
+    }
+
+    if export.Encrypted {
+        return nil, ErrUnsupportedImport
+    }
+
+    var folders = make(map[string]string)
+    for _, folder := range export.Folders {
+        folders[folder.Id] = folder.Name
+    }
+
+    var result = NewImportResult()
+    for i, item := range export.Items {
+        var entry = ImportEntry{
+            Row: i + 1,
+            Category: folders[item.FolderId],
+            Name: strings.TrimSpace(item.Name),
+            Fields: ImportFields{Notes: item.Notes},
+        }
+
+        switch item.Type {
+        case 1:
+            if item.Login != nil {
+                entry.Fields.Username = item.Login.Username
+                entry.Fields.Password = item.Login.Password
+                entry.Fields.Totp = item.Login.Totp
+                if len(item.Login.Uris) > 0 {
+                    entry.Fields.Url = item.Login.Uris[0].Uri
+                }
+            }
+        case 2:
+        default:
+            result.Failed = append(result.Failed, ImportFailure{Row: entry.Row, Reason: "unsupported item type"})
+            continue
+        }
+        result.add(entry)
+    }
+    return result, nil
+}
+
+// Parses a CSV export with a header row, columns are matched by name.
+func ParseCSV(ctx context.Context, r io.Reader) (*ImportResult, error) {
+    reader := csv.NewReader(r)
+    reader.FieldsPerRecord = -1
+
+    header, err := reader.Read()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to read csv header", "err", err)
+        return nil, ErrInvalidImport
+    }
+
+    var columns = make(map[string]int)
+    for i, col := range header {
+        col = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(col, "\ufeff")))
+        if field, ok := csvColumns[col]; ok {
+            if _, exists := columns[field]; !exists {
+                columns[field] = i
+            }
+        }
+    }
+
+    if _, ok := columns["name"]; !ok {
+        if _, ok := columns["url"]; !ok {
+            return nil, ErrInvalidImport
+        }
+    }
+
+    var result = NewImportResult()
+    for row := 2; ; row++ {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            result.Failed = append(result.Failed, ImportFailure{Row: row, Reason: "malformed row"})
+            continue
+        }
+
+        value := func(field string) string {
+            if i, ok := columns[field]; ok && i < len(record) {
+                return strings.TrimSpace(record[i])
+            }
+            return ""
+        }
+
+        result.add(ImportEntry{
+            Row: row,
+            Category: value("category"),
+            Name: value("name"),
+            Fields: ImportFields{
+                Username: value("username"),
+                Password: value("password"),
+                Url: value("url"),
+                Notes: value("notes"),
+                Totp: value("totp"),
+            },
+        })
+    }
+    return result, nil
+}
+
+func (res *ImportResult) add(entry ImportEntry) {
+    if entry.Name == "" {
+        entry.Name = entry.Fields.Url
+    }
+
+    if entry.Name == "" {
+        res.Failed = append(res.Failed, ImportFailure{Row: entry.Row, Reason: "missing name"})
+        return
+    }
+
+    if entry.Fields.Password == "" && entry.Fields.Notes == "" {
+        res.Failed = append(res.Failed, ImportFailure{Row: entry.Row, Reason: "missing password"})
+        return
+    }
+
+    // KeePass nests groups below a "Root" group, only the leaf is kept.
+    if i := strings.LastIndex(entry.Category, "/"); i >= 0 {
+        entry.Category = entry.Category[i + 1:]
+    }
+    entry.Description = entry.Fields.Url
+
+    if entry.Category != "" {
+        var known bool
+        for _, ct := range res.Categories {
+            known = known || ct == entry.Category
+        }
+        if !known {
+            res.Categories = append(res.Categories, entry.Category)
+        }
+    }
+    res.Entries = append(res.Entries, entry)
+}
+
+// Flags entries matching an existing store name or an earlier entry with
+// the same name, username and url.
+func (res *ImportResult) MarkDuplicates(existing []string) {
+    var names = make(map[string]bool)
+    for _, name := range existing {
+        names[strings.ToLower(name)] = true
+    }
+
+    type entryKey struct {
+        name, username, url string
+    }
+
+    var seen = make(map[entryKey]bool)
+    for i := range res.Entries {
+        entry := &res.Entries[i]
+        key := entryKey{strings.ToLower(entry.Name), entry.Fields.Username, entry.Fields.Url}
+
+        entry.Duplicate = names[strings.ToLower(entry.Name)] || seen[key]
+        seen[key] = true
+    }
+}
+
+func (v *VincaDatabase) FetchStoreNames(ctx context.Context, usr *User) ([]string, error) {
+    rows, err := v.db.Query("select name from stores where deleted_at is null and " + sqlStoreReadable, usr.Id, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch store names", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var names []string
+    for rows.Next() {
+        var name string
+        if err = rows.Scan(&name); err != nil {
+            slog.ErrorContext(ctx, "unable to scan store name", "err", err)
+            continue
+        }
+        names = append(names, name)
+    }
+    return names, nil
+}
+
+// Saves encrypted import rows into an owned container. Categories are
+// matched by name and created when missing, rows without content fail.
+func (v *VincaDatabase) ImportStores(ctx context.Context, usr *User, container *Container, entries []ImportStore) (*ImportCommitResult, error) {
+    var result = &ImportCommitResult{Categories: []*Category{}, Stores: []Store{}, Failed: []ImportFailure{}}
+
+    tx, err := v.db.Begin()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to begin store import", "err", err)
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.Query("select id, name from categories where user_id = ?", usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch categories for import", "err", err)
+        return nil, err
+    }
+
+    var categories = make(map[string]int)
+    for rows.Next() {
+        var cid int
+        var name string
+        if err = rows.Scan(&cid, &name); err != nil {
+            rows.Close()
+            slog.ErrorContext(ctx, "unable to scan category for import", "err", err)
+            return nil, err
+        }
+        categories[name] = cid
+    }
+    rows.Close()
+
+    for _, entry := range entries {
+        if entry.Name == "" || len(entry.Content) == 0 {
+            result.Failed = append(result.Failed, ImportFailure{Row: entry.Row, Reason: "missing name or content"})
+            continue
+        }
+
+        category, ok := categories[entry.Category]
+        if !ok && entry.Category != "" {
+            res, err := tx.Exec("insert into categories(user_id, name, description, icon, version) values(?,?,?,?,1)",
+                    usr.Id, entry.Category, "", 0)
+            if err != nil {
+                slog.ErrorContext(ctx, "unable to create imported category", "err", err)
+                return nil, err
+            }
+
+            cid, err := res.LastInsertId()
+            if err != nil {
+                slog.ErrorContext(ctx, "unable to fetch imported category id", "err", err)
+                return nil, err
+            }
+            category = int(cid)
+            categories[entry.Category] = category
+
+            var created = &Category{Id: category, Version: 1}
+            created.Name = entry.Category
+            result.Categories = append(result.Categories, created)
+        }
+
+        var st = Store{Version: 1}
+        st.StoreParam = StoreParam{
+            Name: entry.Name,
+            Description: entry.Description,
+            Container: container.Id,
+            Category: category,
+            Icon: entry.Icon,
+            Color: entry.Color,
+        }
+
+        res, err := tx.Exec("insert into stores(user_id, container_id, category_id, name, description, icon, color, content, version) values(?,?,?,?,?,?,?,?,1)",
+                usr.Id, container.Id, category, entry.Name, entry.Description, entry.Icon, entry.Color, entry.Content)
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to import store", "err", err)
+            return nil, err
+        }
+
+        sid, err := res.LastInsertId()
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to fetch imported store id", "err", err)
+            return nil, err
+        }
+        st.Id = int(sid)
+        result.Stores = append(result.Stores, st)
+    }
+
+    if err = tx.Commit(); err != nil {
+        slog.ErrorContext(ctx, "unable to commit store import", "err", err)
+        return nil, err
+    }
+    return result, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import "context"
+import "strings"
+import "testing"
+
+func TestParseBitwardenJSON(t *testing.T) {
+    const export = `{
+        "encrypted": false,
+        "folders": [{"id": "f1", "name": "Work"}],
+        "items": [
+            {"type": 1, "name": "GitHub", "folderId": "f1", "notes": "",
+             "login": {"username": "octo", "password": "hunter2", "totp": "otpauth://x",
+                       "uris": [{"uri": "https://github.com"}]}},
+            {"type": 2, "name": "Wifi", "folderId": null, "notes": "router secret"},
+            {"type": 3, "name": "Visa"},
+            {"type": 1, "name": "", "login": {"username": "nobody", "password": ""}}
+        ]
+    }`
+
+    res, err := ParseBitwardenJSON(context.Background(), strings.NewReader(export))
+    if err != nil {
+        t.Fatal("unexpected error:", err)
+    }
+
+    if len(res.Entries) != 2 {
+        t.Fatalf("expected 2 entries, got %d", len(res.Entries))
+    }
+
+    gh := res.Entries[0]
+    if gh.Name != "GitHub" || gh.Category != "Work" || gh.Fields.Username != "octo" ||
+        gh.Fields.Password != "hunter2" || gh.Fields.Url != "https://github.com" || gh.Fields.Totp != "otpauth://x" {
+        t.Errorf("unexpected login entry: %+v", gh)
+    }
+
+    if note := res.Entries[1]; note.Name != "Wifi" || note.Category != "" || note.Fields.Notes != "router secret" {
+        t.Errorf("unexpected note entry: %+v", note)
+    }
+
+    if len(res.Categories) != 1 || res.Categories[0] != "Work" {
+        t.Errorf("unexpected categories: %v", res.Categories)
+    }
+
+    if len(res.Failed) != 2 || res.Failed[0].Row != 3 || res.Failed[1].Row != 4 {
+        t.Errorf("unexpected failures: %+v", res.Failed)
+    }
+}
+
+func TestParseBitwardenJSONRejects(t *testing.T) {
+    var tests = []struct {
+        name string
+        data string
+        err error
+    }{
+        {"encrypted", `{"encrypted": true, "items": []}`, ErrUnsupportedImport},
+        {"malformed", `{"items": [`, ErrInvalidImport},
+    }
+
+    for _, tt := range tests {
+        if _, err := ParseBitwardenJSON(context.Background(), strings.NewReader(tt.data)); err != tt.err {
+            t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+        }
+    }
+}
+
+func TestParseCSV(t *testing.T) {
+    var tests = []struct {
+        name string
+        data string
+        entries []ImportEntry
+        failed []int
+    }{
+        {
+            name: "keepass",
+            data: "\"Group\",\"Title\",\"Username\",\"Password\",\"URL\",\"Notes\"\n" +
+                "\"Root/Mail\",\"Inbox\",\"me\",\"secret\",\"https://mail.example\",\"\"\n" +
+                "\"Root\",\"\",\"\",\"\",\"\",\"\"\n",
+            entries: []ImportEntry{
+                {Row: 2, Category: "Mail", Name: "Inbox", Description: "https://mail.example",
+                    Fields: ImportFields{Username: "me", Password: "secret", Url: "https://mail.example"}},
+            },
+            failed: []int{3},
+        },
+        {
+            name: "chrome",
+            data: "name,url,username,password,note\n" +
+                "example.com,https://example.com/login,alice,pw1,\n" +
+                ",https://other.example,bob,pw2,remember me\n",
+            entries: []ImportEntry{
+                {Row: 2, Name: "example.com", Description: "https://example.com/login",
+                    Fields: ImportFields{Username: "alice", Password: "pw1", Url: "https://example.com/login"}},
+                {Row: 3, Name: "https://other.example", Description: "https://other.example",
+                    Fields: ImportFields{Username: "bob", Password: "pw2", Url: "https://other.example", Notes: "remember me"}},
+            },
+        },
+        {
+            name: "short row",
+            data: "title,username,password\nShort,only\n",
+            failed: []int{2},
+        },
+    }
+
+    for _, tt := range tests {
+        res, err := ParseCSV(context.Background(), strings.NewReader(tt.data))
+        if err != nil {
+            t.Errorf("%s: unexpected error: %v", tt.name, err)
+            continue
+        }
+
+        if len(res.Entries) != len(tt.entries) {
+            t.Errorf("%s: expected %d entries, got %+v", tt.name, len(tt.entries), res.Entries)
+            continue
+        }
+        for i, entry := range tt.entries {
+            if res.Entries[i] != entry {
+                t.Errorf("%s: entry %d expected %+v, got %+v", tt.name, i, entry, res.Entries[i])
+            }
+        }
+
+        if len(res.Failed) != len(tt.failed) {
+            t.Errorf("%s: expected failures %v, got %+v", tt.name, tt.failed, res.Failed)
+            continue
+        }
+        for i, row := range tt.failed {
+            if res.Failed[i].Row != row {
+                t.Errorf("%s: expected failed row %d, got %d", tt.name, row, res.Failed[i].Row)
+            }
+        }
+    }
+}
+
+func TestParseCSVRejectsUnknownHeader(t *testing.T) {
+    if _, err := ParseCSV(context.Background(), strings.NewReader("foo,bar\n1,2\n")); err != ErrInvalidImport {
+        t.Errorf("expected %v, got %v", ErrInvalidImport, err)
+    }
+}
+
+func TestMarkDuplicates(t *testing.T) {
+    var res = NewImportResult()
+    res.add(ImportEntry{Row: 1, Name: "Mail", Fields: ImportFields{Username: "a", Password: "x"}})
+    res.add(ImportEntry{Row: 2, Name: "mail", Fields: ImportFields{Username: "a", Password: "y"}})
+    res.add(ImportEntry{Row: 3, Name: "Bank", Fields: ImportFields{Username: "a", Password: "z"}})
+    res.add(ImportEntry{Row: 4, Name: "Forum", Fields: ImportFields{Username: "a", Password: "z"}})
+
+    res.MarkDuplicates([]string{"BANK"})
+
+    var expected = []bool{false, true, true, false}
+    for i, dup := range expected {
+        if res.Entries[i].Duplicate != dup {
+            t.Errorf("entry %d expected duplicate %v", res.Entries[i].Row, dup)
+        }
+    }
+}
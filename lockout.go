@@ -0,0 +1,135 @@
+package main
+
+import "context"
+import "log/slog"
+import "sync"
+import "time"
+import "strings"
+
+type LoginAttempts struct {
+    failures int
+    lastFailure time.Time
+    lockedUntil time.Time
+}
+
+type LoginGuard struct {
+    mu sync.Mutex
+    attempts map[string]*LoginAttempts
+    threshold int
+    delay time.Duration
+    maxDelay time.Duration
+}
+
+func NewLoginGuard(cfg LockoutConfig) *LoginGuard {
+    lg := &LoginGuard{
+        attempts: make(map[string]*LoginAttempts),
+        threshold: cfg.Attempts(),
+        delay: cfg.BaseDelay(),
+        maxDelay: cfg.MaxBackoff(),
+    }
+
+    go func() {
+        ticker := time.NewTicker(time.Minute)
+        defer ticker.Stop()
+
+        for range ticker.C {
+            lg.Reap()
+        }
+    }()
+    return lg
+}
+
+func LoginAccountKey(email string) string {
+    return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func LoginAddressKey(host string) string {
+    return "address:" + host
+}
+
+// Registers a login attempt for every key before the password is checked,
+// so concurrent requests are counted even before any of them fails.
+// Returns ErrLoginLocked when one of the keys is still locked out.
+func (lg *LoginGuard) Attempt(ctx context.Context, keys ...string) error {
+    now := time.Now()
+
+    lg.mu.Lock()
+    defer lg.mu.Unlock()
+
+    for _, key := range keys {
+        if la, ok := lg.attempts[key]; ok && now.Before(la.lockedUntil) {
+            slog.WarnContext(ctx, "login locked", "key", key, "until", la.lockedUntil)
+            return ErrLoginLocked
+        }
+    }
+
+    for _, key := range keys {
+        la, ok := lg.attempts[key]
+        if !ok {
+            la = &LoginAttempts{}
+            lg.attempts[key] = la
+        }
+
+        la.failures++
+        la.lastFailure = now
+        if la.failures >= lg.threshold {
+            la.lockedUntil = now.Add(lg.backoff(la.failures))
+        }
+    }
+    return nil
+}
+
+// Clears the attempt counters after a successful login.
+func (lg *LoginGuard) Succeeded(keys ...string) {
+    lg.mu.Lock()
+    defer lg.mu.Unlock()
+
+    for _, key := range keys {
+        delete(lg.attempts, key)
+    }
+}
+
+// Takes back the attempt registered for keys shared between accounts,
+// so successful logins from one address do not count against it.
+func (lg *LoginGuard) Release(keys ...string) {
+    lg.mu.Lock()
+    defer lg.mu.Unlock()
+
+    for _, key := range keys {
+        la, ok := lg.attempts[key]
+        if !ok {
+            continue
+        }
+
+        if la.failures--; la.failures <= 0 {
+            delete(lg.attempts, key)
+        } else if la.failures < lg.threshold {
+            la.lockedUntil = time.Time{}
+        }
+    }
+}
+
+func (lg *LoginGuard) backoff(failures int) time.Duration {
+    delay := lg.delay
+    for i := lg.threshold; i < failures && delay < lg.maxDelay; i++ {
+        delay *= 2
+    }
+
+    if delay > lg.maxDelay {
+        return lg.maxDelay
+    }
+    return delay
+}
+
+func (lg *LoginGuard) Reap() {
+    now := time.Now()
+
+    lg.mu.Lock()
+    defer lg.mu.Unlock()
+
+    for key, la := range lg.attempts {
+        if now.After(la.lockedUntil) && now.Sub(la.lastFailure) > lg.maxDelay {
+            delete(lg.attempts, key)
+        }
+    }
+}
@@ -0,0 +1,159 @@
+package main
+
+import "os"
+import "io"
+import "context"
+import "strings"
+import "log/slog"
+import "crypto/rand"
+import "encoding/hex"
+
+const RequestIdHeader = "Vinca-Request-Id"
+
+const redacted = "[REDACTED]"
+
+// Id of the request handled in a context, RedactHandler adds it to lines
+// logged with that context so the storage layer needs no request logger.
+var LogRequestId = NewContextKey[string]("request id")
+
+// Attribute keys never written to the log, matched case insensitive
+// against the key or any of its parts separated by _, - or dots.
+var redactedKeys = map[string]bool{
+    "password": true,
+    "confirmation": true,
+    "token": true,
+    "secret": true,
+    "code": true,
+    "codes": true,
+    "hash": true,
+    "content": true,
+    "encrypted": true,
+    "pending": true,
+    "authentication": true,
+    "authorization": true,
+    "cookie": true,
+}
+
+// Level is one of debug, info, warn or error, Format either text or json.
+type LogConfig struct {
+    Level string `json:"level"`
+    Format string `json:"format"`
+}
+
+func (lc LogConfig) SlogLevel() slog.Level {
+    switch strings.ToLower(lc.Level) {
+    case "debug":
+        return slog.LevelDebug
+    case "warn":
+        return slog.LevelWarn
+    case "error":
+        return slog.LevelError
+    }
+    return slog.LevelInfo
+}
+
+// Drops the value of every attribute with a sensitive key before it is
+// handed to the wrapped handler. The request id of the context is added
+// unless the logger already carries one.
+type RedactHandler struct {
+    slog.Handler
+    requestId bool
+}
+
+func NewLogger(cfg LogConfig, w io.Writer) *slog.Logger {
+    var opts = &slog.HandlerOptions{Level: cfg.SlogLevel()}
+
+    var handler slog.Handler
+    if strings.ToLower(cfg.Format) == "json" {
+        handler = slog.NewJSONHandler(w, opts)
+    } else {
+        handler = slog.NewTextHandler(w, opts)
+    }
+    return slog.New(RedactHandler{Handler: handler})
+}
+
+// Installs the configured logger as default, output of the standard log
+// package is routed through it as well.
+func SetupLogging(cfg LogConfig) {
+    slog.SetDefault(NewLogger(cfg, os.Stderr))
+}
+
+func RedactedKey(key string) bool {
+    key = strings.ToLower(key)
+    if redactedKeys[key] {
+        return true
+    }
+
+    for _, part := range strings.FieldsFunc(key, func(c rune) bool {
+        return c == '_' || c == '-' || c == '.'
+    }) {
+        if redactedKeys[part] {
+            return true
+        }
+    }
+    return false
+}
+
+func RedactAttr(attr slog.Attr) slog.Attr {
+    if RedactedKey(attr.Key) {
+        return slog.String(attr.Key, redacted)
+    }
+
+    value := attr.Value.Resolve()
+    if value.Kind() != slog.KindGroup {
+        return slog.Attr{Key: attr.Key, Value: value}
+    }
+
+    var attrs []slog.Attr
+    for _, ga := range value.Group() {
+        attrs = append(attrs, RedactAttr(ga))
+    }
+    return slog.Attr{Key: attr.Key, Value: slog.GroupValue(attrs...)}
+}
+
+func (rh RedactHandler) Handle(ctx context.Context, record slog.Record) error {
+    var clean = slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+    if id, ok := ContextValue(ctx, LogRequestId); ok && !rh.requestId {
+        clean.AddAttrs(slog.String("request_id", id))
+    }
+    record.Attrs(func(attr slog.Attr) bool {
+        clean.AddAttrs(RedactAttr(attr))
+        return true
+    })
+    return rh.Handler.Handle(ctx, clean)
+}
+
+func (rh RedactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    var requestId = rh.requestId
+    var clean = make([]slog.Attr, len(attrs))
+    for i, attr := range attrs {
+        clean[i] = RedactAttr(attr)
+        requestId = requestId || attr.Key == "request_id"
+    }
+    return RedactHandler{Handler: rh.Handler.WithAttrs(clean), requestId: requestId}
+}
+
+func (rh RedactHandler) WithGroup(name string) slog.Handler {
+    return RedactHandler{Handler: rh.Handler.WithGroup(name), requestId: rh.requestId}
+}
+
+// Short random id correlating all log lines of a single request.
+func NewRequestId() string {
+    var buf = make([]byte, 8)
+    if _, err := rand.Read(buf); err != nil {
+        return "unknown"
+    }
+    return hex.EncodeToString(buf)
+}
+
+// Only the public parts of an user are logged.
+func (usr *User) LogValue() slog.Value {
+    if usr == nil {
+        return slog.StringValue("<nil>")
+    }
+    return slog.GroupValue(slog.Int("id", usr.Id), slog.String("username", usr.Username))
+}
+
+func (p UserParam) LogValue() slog.Value {
+    return slog.GroupValue(slog.String("username", p.Username), slog.String("email", p.Email))
+}
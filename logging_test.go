@@ -0,0 +1,113 @@
+package main
+
+import "bytes"
+import "context"
+import "strings"
+import "sync"
+import "testing"
+import "log/slog"
+import "encoding/json"
+import "net/http/httptest"
+
+func TestRedactHandler(t *testing.T) {
+    var buf bytes.Buffer
+    logger := NewLogger(LogConfig{Format: "json"}, &buf).With("session_token", "with-secret")
+
+    logger.Info("login",
+        "password", "hunter2",
+        "Reset-Token", "abcdef",
+        slog.Group("request", "confirmation", "hunter3", "path", "/api/v1/auth/login"),
+        "user", UserParam{Username: "alice", Email: "alice@example.com", Password: "hunter4"},
+        "store", 12,
+    )
+
+    out := buf.String()
+    for _, secret := range []string{"hunter2", "abcdef", "hunter3", "hunter4", "with-secret"} {
+        if strings.Contains(out, secret) {
+            t.Errorf("secret %q leaked into log: %s", secret, out)
+        }
+    }
+
+    for _, public := range []string{"/api/v1/auth/login", "alice@example.com", `"store":12`} {
+        if !strings.Contains(out, public) {
+            t.Errorf("expected %q in log: %s", public, out)
+        }
+    }
+}
+
+func TestRequestIdHeader(t *testing.T) {
+    var ids = make(map[string]bool)
+    for i := 0; i < 2; i++ {
+        w := httptest.NewRecorder()
+        vincaMux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/auth/session", nil))
+
+        id := w.Header().Get(RequestIdHeader)
+        if len(id) != 16 || ids[id] {
+            t.Fatalf("unexpected request id %q", id)
+        }
+        ids[id] = true
+    }
+}
+
+// Guards the log output written by handlers of the test server.
+type syncBuffer struct {
+    mu sync.Mutex
+    buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+    sb.mu.Lock()
+    defer sb.mu.Unlock()
+    return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+    sb.mu.Lock()
+    defer sb.mu.Unlock()
+    return sb.buf.String()
+}
+
+func TestRequestIdContext(t *testing.T) {
+    var out syncBuffer
+    defer slog.SetDefault(slog.Default())
+    slog.SetDefault(NewLogger(LogConfig{Level: "debug", Format: "json"}, &out))
+
+    h := newApiHarness(t)
+    email := h.login(t, "logging")
+
+    var ids = make(map[string]string)
+    for _, req := range []struct{ path string; body interface{} }{
+        {"/api/v1/auth/login", UserParam{Email: email, Password: "Wrong lanterns 4 ever"}},
+        {"/api/v1/auth/reset", ResetRequest{Email: email}},
+    } {
+        resp := h.request(t, context.Background(), "POST", req.path, req.body, true)
+        resp.Body.Close()
+        ids[req.path] = resp.Header.Get(RequestIdHeader)
+    }
+
+    var lines = make(map[string]map[string]interface{})
+    for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+        var entry = make(map[string]interface{})
+        if err := json.Unmarshal([]byte(line), &entry); err != nil {
+            t.Fatalf("unable to decode log line %s: %v", line, err)
+        }
+        lines[entry["msg"].(string)] = entry
+    }
+
+    for msg, path := range map[string]string{"password mismatch": "/api/v1/auth/login", "notify": "/api/v1/auth/reset"} {
+        entry, ok := lines[msg]
+        if !ok {
+            t.Fatalf("missing log line %q: %s", msg, out.String())
+        }
+        if entry["request_id"] != ids[path] {
+            t.Errorf("log line %q has request id %v, expected %s", msg, entry["request_id"], ids[path])
+        }
+        if entry["level"] != "DEBUG" && entry["level"] != "INFO" {
+            t.Errorf("log line %q logged at %v", msg, entry["level"])
+        }
+    }
+
+    if strings.Contains(out.String(), "reset token") {
+        t.Errorf("reset token leaked into log: %s", out.String())
+    }
+}
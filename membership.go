@@ -0,0 +1,149 @@
+package main
+
+import "context"
+import "log/slog"
+import "net/http"
+import "database/sql"
+
+const MemberRead = "read"
+const MemberWrite = "write"
+
+var ErrContainerReadOnly = NewHandlerErr("container_read_only", http.StatusForbidden)
+var ErrInvalidMember = NewHandlerErr("container_member_invalid", http.StatusBadRequest)
+
+// Stores readable by the user, its own ones and every store inside of
+// a container shared with the user. Takes the user id twice.
+const sqlStoreReadable = "(user_id = ? or container_id in (select container_id from container_members where user_id = ?))"
+
+// Same as sqlStoreReadable but limited to containers shared with write access.
+const sqlStoreWritable = "(user_id = ? or container_id in (select container_id from container_members where user_id = ? and role = 'write'))"
+
+type ContainerMember struct {
+    Username string `json:"username"`
+    Email string `json:"email"`
+    Role string `json:"role"`
+    Encrypted []byte `json:"encrypted,omitempty"`
+    userid int
+}
+
+type MemberKey struct {
+    Email string `json:"email"`
+    Encrypted []byte `json:"encrypted"`
+}
+
+func ValidMemberRole(role string) bool {
+    return role == MemberRead || role == MemberWrite
+}
+
+// Fetches a container shared with the user, the Encrypted field holds
+// the member's own wrapped copy of the container key.
+func (v *VincaDatabase) FetchSharedContainer(ctx context.Context, container *Container, usr *User) error {
+    err := v.db.QueryRow("select c.name, c.public, m.encrypted, m.role from containers c join container_members m on m.container_id = c.id where c.id = ? and m.user_id = ?",
+            container.Id, usr.Id).Scan(&container.Name, &container.Certificate, &container.Encrypted, &container.Role)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch shared container", "err", err)
+        return err
+    }
+    container.Shared = true
+    return nil
+}
+
+// Fetches a container owned by the user. Members of the container get
+// ErrForbidden, so they can tell it apart from a missing container.
+func (v *VincaDatabase) FetchOwnedContainer(ctx context.Context, container *Container, usr *User) error {
+    err := v.FetchContainer(ctx, container, usr)
+    if err != sql.ErrNoRows {
+        return err
+    }
+
+    var shared = Container{Id: container.Id}
+    if v.FetchSharedContainer(ctx, &shared, usr) == nil {
+        return ErrForbidden
+    }
+    return err
+}
+
+func (v *VincaDatabase) FetchSharedContainers(ctx context.Context, usr *User) ([]Container, error) {
+    rows, err := v.db.Query("select c.id, c.name, c.public, m.encrypted, m.role from containers c join container_members m on m.container_id = c.id where m.user_id = ? order by c.id asc", usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch shared containers", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var containers []Container
+    for rows.Next() {
+        var container = Container{Shared: true}
+        if err = rows.Scan(&container.Id, &container.Name, &container.Certificate, &container.Encrypted, &container.Role); err != nil {
+            slog.ErrorContext(ctx, "unable to scan shared container", "err", err)
+            continue
+        }
+        containers = append(containers, container)
+    }
+    return containers, nil
+}
+
+func (v *VincaDatabase) FetchMembers(ctx context.Context, container *Container) ([]ContainerMember, error) {
+    rows, err := v.db.Query("select u.id, u.username, u.email, m.role from container_members m join users u on u.id = m.user_id where m.container_id = ? order by u.username asc", container.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch container members", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var members []ContainerMember
+    for rows.Next() {
+        var member = ContainerMember{}
+        if err = rows.Scan(&member.userid, &member.Username, &member.Email, &member.Role); err != nil {
+            slog.ErrorContext(ctx, "unable to scan container member", "err", err)
+            continue
+        }
+        members = append(members, member)
+    }
+    return members, nil
+}
+
+func (v *VincaDatabase) SaveMember(ctx context.Context, container *Container, member *ContainerMember) error {
+    if _, err := v.db.Exec("delete from container_members where container_id = ? and user_id = ?", container.Id, member.userid); err != nil {
+        slog.ErrorContext(ctx, "unable to replace container member", "err", err)
+        return err
+    }
+
+    _, err := v.db.Exec("insert into container_members(container_id, user_id, role, encrypted) values(?,?,?,?)",
+            container.Id, member.userid, member.Role, member.Encrypted)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to save container member", "err", err)
+        return err
+    }
+    return nil
+}
+
+func (v *VincaDatabase) DestroyMember(ctx context.Context, container *Container, member *ContainerMember) error {
+    res, err := v.db.Exec("delete from container_members where container_id = ? and user_id = ?", container.Id, member.userid)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to remove container member", "err", err)
+        return err
+    }
+
+    rows, err := res.RowsAffected()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch removed member count", "err", err)
+        return nil
+    }
+
+    if rows != 1 {
+        return ErrInvalidMember
+    }
+    v.SaveTombstone(ctx, member.userid, container.Id, TombstoneContainer, container.Id)
+    return nil
+}
+
+func (v *VincaDatabase) StoreWritable(ctx context.Context, usr *User, st *Store) bool {
+    var count int
+    err := v.db.QueryRow("select count(*) from stores where id = ? and " + sqlStoreWritable, st.Id, usr.Id, usr.Id).Scan(&count)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to check store permissions", "err", err)
+        return false
+    }
+    return count == 1
+}
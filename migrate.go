@@ -0,0 +1,238 @@
+package main
+
+import "fmt"
+import "log/slog"
+import "sort"
+import "embed"
+import "strings"
+import "strconv"
+import "io/fs"
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+type Migration struct {
+    Version int
+    Name string
+    Up string
+    Down string
+}
+
+type MigrationStatus struct {
+    Current int
+    Applied []Migration
+    Pending []Migration
+}
+
+// Loads the migrations of the driver dialect, files are named
+// NNNN_name.up.sql and NNNN_name.down.sql. A version stands for the same
+// schema on every dialect, SQLite starts at 0009 with the consolidated
+// schema of the earlier MySQL migrations.
+func LoadMigrations(driver string) ([]Migration, error) {
+    dialect := DriverMySQL
+    if driver == DriverSQLite || driver == DriverMemory {
+        dialect = DriverSQLite
+    }
+
+    dir := "migrations/" + dialect
+    entries, err := fs.ReadDir(migrationFiles, dir)
+    if err != nil {
+        return nil, err
+    }
+
+    var byVersion = make(map[int]*Migration)
+    for _, entry := range entries {
+        name := entry.Name()
+        var direction string
+        switch {
+        case strings.HasSuffix(name, ".up.sql"):
+            direction = "up"
+        case strings.HasSuffix(name, ".down.sql"):
+            direction = "down"
+        default:
+            continue
+        }
+
+        parts := strings.SplitN(strings.TrimSuffix(name, "." + direction + ".sql"), "_", 2)
+        version, err := strconv.Atoi(parts[0])
+        if err != nil || len(parts) != 2 {
+            return nil, fmt.Errorf("invalid migration file name: %s", name)
+        }
+
+        data, err := fs.ReadFile(migrationFiles, dir + "/" + name)
+        if err != nil {
+            return nil, err
+        }
+
+        mg, ok := byVersion[version]
+        if !ok {
+            mg = &Migration{Version: version, Name: parts[1]}
+            byVersion[version] = mg
+        }
+
+        if direction == "up" {
+            mg.Up = string(data)
+        } else {
+            mg.Down = string(data)
+        }
+    }
+
+    var migrations []Migration
+    for _, mg := range byVersion {
+        if mg.Up == "" {
+            return nil, fmt.Errorf("migration %d has no up script", mg.Version)
+        }
+        migrations = append(migrations, *mg)
+    }
+
+    sort.Slice(migrations, func(i, j int) bool {
+        return migrations[i].Version < migrations[j].Version
+    })
+    return migrations, nil
+}
+
+// Neither driver runs multiple statements in one Exec by default.
+func splitStatements(script string) []string {
+    var stmts []string
+    for _, stmt := range strings.Split(script, ";") {
+        if stmt = strings.TrimSpace(stmt); stmt != "" {
+            stmts = append(stmts, stmt)
+        }
+    }
+    return stmts
+}
+
+func (vb *VincaDatabase) appliedMigrations() (map[int]bool, error) {
+    _, err := vb.db.Exec("create table if not exists schema_migrations (version integer not null primary key, name varchar(255) not null, applied datetime not null default current_timestamp)")
+    if err != nil {
+        slog.Error("unable to create schema_migrations", "err", err)
+        return nil, err
+    }
+
+    rows, err := vb.db.Query("select version from schema_migrations")
+    if err != nil {
+        slog.Error("unable to fetch applied migrations", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var applied = make(map[int]bool)
+    for rows.Next() {
+        var version int
+        if err = rows.Scan(&version); err != nil {
+            return nil, err
+        }
+        applied[version] = true
+    }
+    return applied, rows.Err()
+}
+
+func (vb *VincaDatabase) MigrationStatus() (*MigrationStatus, error) {
+    migrations, err := LoadMigrations(vb.driver)
+    if err != nil {
+        return nil, err
+    }
+
+    applied, err := vb.appliedMigrations()
+    if err != nil {
+        return nil, err
+    }
+
+    var status = &MigrationStatus{}
+    for _, mg := range migrations {
+        if applied[mg.Version] {
+            status.Applied = append(status.Applied, mg)
+            status.Current = mg.Version
+        } else {
+            status.Pending = append(status.Pending, mg)
+        }
+    }
+    return status, nil
+}
+
+func (vb *VincaDatabase) MigrateUp() error {
+    status, err := vb.MigrationStatus()
+    if err != nil {
+        return err
+    }
+
+    for _, mg := range status.Pending {
+        slog.Info("applying migration", "version", mg.Version, "name", mg.Name)
+        err := vb.runMigration(mg.Up, "insert into schema_migrations(version, name) values(?,?)", mg.Version, mg.Name)
+        if err != nil {
+            return fmt.Errorf("migration %04d_%s: %v", mg.Version, mg.Name, err)
+        }
+    }
+    return nil
+}
+
+// Reverts the most recently applied migration.
+func (vb *VincaDatabase) MigrateDown() error {
+    status, err := vb.MigrationStatus()
+    if err != nil {
+        return err
+    }
+
+    if len(status.Applied) == 0 {
+        slog.Info("no migrations to revert")
+        return nil
+    }
+
+    mg := status.Applied[len(status.Applied) - 1]
+    if mg.Down == "" {
+        return fmt.Errorf("migration %04d_%s can not be reverted", mg.Version, mg.Name)
+    }
+
+    slog.Info("reverting migration", "version", mg.Version, "name", mg.Name)
+    err = vb.runMigration(mg.Down, "delete from schema_migrations where version = ?", mg.Version)
+    if err != nil {
+        return fmt.Errorf("migration %04d_%s: %v", mg.Version, mg.Name, err)
+    }
+    return nil
+}
+
+// Runs the script and records it in schema_migrations within the same
+// transaction. MySQL commits schema changes implicitly, so the transaction
+// only protects data statements. Migrations should stay small for that reason.
+func (vb *VincaDatabase) runMigration(script, record string, args ...interface{}) error {
+    tx, err := vb.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    for _, stmt := range splitStatements(script) {
+        if _, err := tx.Exec(stmt); err != nil {
+            return err
+        }
+    }
+
+    if _, err := tx.Exec(record, args...); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (vb *VincaDatabase) RunMigrateCommand(command string) error {
+    switch command {
+    case "up":
+        return vb.MigrateUp()
+    case "down":
+        return vb.MigrateDown()
+    case "status":
+        status, err := vb.MigrationStatus()
+        if err != nil {
+            return err
+        }
+
+        fmt.Println("current version:", status.Current)
+        for _, mg := range status.Applied {
+            fmt.Printf("  applied  %04d_%s\n", mg.Version, mg.Name)
+        }
+        for _, mg := range status.Pending {
+            fmt.Printf("  pending  %04d_%s\n", mg.Version, mg.Name)
+        }
+        return nil
+    }
+    return fmt.Errorf("unknown migrate command: %s", command)
+}
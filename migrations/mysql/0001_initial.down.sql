@@ -0,0 +1,4 @@
+drop table stores;
+drop table categories;
+drop table containers;
+drop table users;
@@ -0,0 +1,44 @@
+create table if not exists users (
+    id int not null auto_increment primary key,
+    username varchar(16) not null,
+    email varchar(255) not null unique,
+    password varbinary(128) not null,
+    avatar varchar(255) not null default '',
+    show_last_used tinyint(1) not null default 0,
+    dark_mode tinyint(1) not null default 0
+) engine=InnoDB default charset=utf8mb4;
+
+create table if not exists containers (
+    id int not null auto_increment primary key,
+    user_id int not null,
+    name varchar(255) not null,
+    public blob,
+    encrypted blob,
+    key containers_user (user_id)
+) engine=InnoDB default charset=utf8mb4;
+
+create table if not exists categories (
+    id int not null auto_increment primary key,
+    user_id int not null,
+    name varchar(255) not null,
+    description varchar(1024) not null default '',
+    icon int not null default 0,
+    key categories_user (user_id)
+) engine=InnoDB default charset=utf8mb4;
+
+create table if not exists stores (
+    id int not null auto_increment primary key,
+    user_id int not null,
+    container_id int not null,
+    category_id int not null default 0,
+    created datetime not null default current_timestamp,
+    last_used datetime null,
+    modified datetime not null default current_timestamp,
+    name varchar(255) not null,
+    description varchar(1024) not null default '',
+    icon int not null default 0,
+    color int not null default 0,
+    content mediumblob,
+    key stores_user (user_id, category_id),
+    key stores_container (container_id)
+) engine=InnoDB default charset=utf8mb4;
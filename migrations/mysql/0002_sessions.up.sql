@@ -0,0 +1,9 @@
+create table sessions (
+    id char(36) not null primary key,
+    user_id int not null,
+    created datetime not null,
+    last_seen datetime not null,
+    remote_addr varchar(64) not null default '',
+    user_agent varchar(512) not null default '',
+    key sessions_user (user_id)
+) engine=InnoDB default charset=utf8mb4;
@@ -0,0 +1,7 @@
+create table password_resets (
+    user_id int not null,
+    token binary(32) not null,
+    expires datetime not null,
+    key password_resets_user (user_id),
+    key password_resets_token (token)
+) engine=InnoDB;
@@ -0,0 +1,5 @@
+drop table recovery_codes;
+
+alter table users
+    drop column totp_secret,
+    drop column totp_enabled;
@@ -0,0 +1,9 @@
+alter table users
+    add column totp_secret varbinary(64) null,
+    add column totp_enabled tinyint(1) not null default 0;
+
+create table recovery_codes (
+    user_id int not null,
+    code binary(32) not null,
+    key recovery_codes_user (user_id, code)
+) engine=InnoDB;
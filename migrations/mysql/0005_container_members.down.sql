@@ -0,0 +1 @@
+drop table container_members;
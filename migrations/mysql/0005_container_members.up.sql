@@ -0,0 +1,8 @@
+create table container_members (
+    container_id int not null,
+    user_id int not null,
+    role varchar(8) not null,
+    encrypted blob,
+    primary key (container_id, user_id),
+    key container_members_user (user_id)
+) engine=InnoDB;
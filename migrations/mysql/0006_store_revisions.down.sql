@@ -0,0 +1 @@
+drop table store_revisions;
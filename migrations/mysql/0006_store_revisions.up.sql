@@ -0,0 +1,11 @@
+create table store_revisions (
+    id int not null auto_increment primary key,
+    store_id int not null,
+    created datetime not null default current_timestamp,
+    name varchar(255) not null,
+    description varchar(1024) not null default '',
+    icon int not null default 0,
+    color int not null default 0,
+    content mediumblob,
+    key store_revisions_store (store_id)
+) engine=InnoDB default charset=utf8mb4;
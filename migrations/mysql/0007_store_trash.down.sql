@@ -0,0 +1,4 @@
+delete from stores where deleted_at is not null;
+
+alter table stores
+    drop column deleted_at;
@@ -0,0 +1,2 @@
+alter table stores
+    add column deleted_at datetime null;
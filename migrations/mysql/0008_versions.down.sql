@@ -0,0 +1,5 @@
+alter table categories
+    drop column version;
+
+alter table stores
+    drop column version;
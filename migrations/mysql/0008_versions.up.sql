@@ -0,0 +1,5 @@
+alter table stores
+    add column version int not null default 1;
+
+alter table categories
+    add column version int not null default 1;
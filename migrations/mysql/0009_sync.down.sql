@@ -0,0 +1,10 @@
+drop table tombstones;
+
+alter table container_members
+    drop column modified;
+
+alter table containers
+    drop column modified;
+
+alter table categories
+    drop column modified;
@@ -0,0 +1,22 @@
+alter table stores
+    modify modified datetime not null default current_timestamp;
+
+alter table categories
+    add column modified datetime not null default current_timestamp;
+
+alter table containers
+    add column modified datetime not null default current_timestamp;
+
+alter table container_members
+    add column modified datetime not null default current_timestamp;
+
+create table tombstones (
+    id int not null auto_increment primary key,
+    user_id int not null,
+    container_id int not null default 0,
+    kind varchar(16) not null,
+    object_id int not null,
+    deleted datetime not null default current_timestamp,
+    key tombstones_user (user_id, deleted),
+    key tombstones_container (container_id, deleted)
+) engine=InnoDB;
@@ -0,0 +1,2 @@
+alter table users
+    add column totp_step bigint not null default 0;
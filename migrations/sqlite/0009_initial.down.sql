@@ -0,0 +1,10 @@
+drop table recovery_codes;
+drop table password_resets;
+drop table sessions;
+drop table tombstones;
+drop table store_revisions;
+drop table stores;
+drop table categories;
+drop table container_members;
+drop table containers;
+drop table users;
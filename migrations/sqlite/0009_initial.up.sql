@@ -0,0 +1,108 @@
+-- SQLite is unable to add columns defaulting to current_timestamp, its
+-- schema starts with the state of the MySQL migrations 0001 to 0009 so
+-- every version names the same schema on both drivers.
+
+create table users (
+    id integer primary key autoincrement,
+    username text not null,
+    email text not null unique,
+    password blob not null,
+    avatar text not null default '',
+    show_last_used integer not null default 0,
+    dark_mode integer not null default 0,
+    totp_secret blob,
+    totp_enabled integer not null default 0
+);
+
+create table containers (
+    id integer primary key autoincrement,
+    user_id integer not null,
+    name text not null,
+    public blob,
+    encrypted blob,
+    modified datetime not null default current_timestamp
+);
+
+create table container_members (
+    container_id integer not null,
+    user_id integer not null,
+    role text not null,
+    encrypted blob,
+    modified datetime not null default current_timestamp,
+    primary key (container_id, user_id)
+);
+
+create table categories (
+    id integer primary key autoincrement,
+    user_id integer not null,
+    name text not null,
+    description text not null default '',
+    icon integer not null default 0,
+    version integer not null default 1,
+    modified datetime not null default current_timestamp
+);
+
+create table stores (
+    id integer primary key autoincrement,
+    user_id integer not null,
+    container_id integer not null,
+    category_id integer not null default 0,
+    created datetime not null default current_timestamp,
+    last_used datetime,
+    modified datetime not null default current_timestamp,
+    deleted_at datetime,
+    name text not null,
+    description text not null default '',
+    icon integer not null default 0,
+    color integer not null default 0,
+    content blob,
+    version integer not null default 1
+);
+
+create table store_revisions (
+    id integer primary key autoincrement,
+    store_id integer not null,
+    created datetime not null default current_timestamp,
+    name text not null,
+    description text not null default '',
+    icon integer not null default 0,
+    color integer not null default 0,
+    content blob
+);
+
+create table tombstones (
+    id integer primary key autoincrement,
+    user_id integer not null,
+    container_id integer not null default 0,
+    kind text not null,
+    object_id integer not null,
+    deleted datetime not null default current_timestamp
+);
+
+create table sessions (
+    id text primary key,
+    user_id integer not null,
+    created datetime not null,
+    last_seen datetime not null,
+    remote_addr text not null default '',
+    user_agent text not null default ''
+);
+
+create table password_resets (
+    user_id integer not null,
+    token blob not null,
+    expires datetime not null
+);
+
+create table recovery_codes (
+    user_id integer not null,
+    code blob not null
+);
+
+create index stores_user on stores(user_id, category_id);
+
+create index stores_container on stores(container_id);
+
+create index store_revisions_store on store_revisions(store_id);
+
+create index tombstones_user on tombstones(user_id, deleted);
@@ -0,0 +1,20 @@
+-- SQLite before 3.35 is unable to drop columns, the table is rebuilt.
+
+create table users_previous (
+    id integer primary key autoincrement,
+    username text not null,
+    email text not null unique,
+    password blob not null,
+    avatar text not null default '',
+    show_last_used integer not null default 0,
+    dark_mode integer not null default 0,
+    totp_secret blob,
+    totp_enabled integer not null default 0
+);
+
+insert into users_previous(id, username, email, password, avatar, show_last_used, dark_mode, totp_secret, totp_enabled)
+    select id, username, email, password, avatar, show_last_used, dark_mode, totp_secret, totp_enabled from users;
+
+drop table users;
+
+alter table users_previous rename to users;
@@ -0,0 +1,2 @@
+alter table users
+    add column totp_step integer not null default 0;
@@ -0,0 +1,52 @@
+package main
+
+import "os"
+import "context"
+import "log/slog"
+import "fmt"
+import "sync"
+import "time"
+
+type Notifier interface {
+    Notify(ctx context.Context, usr *User, subject, message string) error
+}
+
+// Writes notifications to the server log, meant for local testing only.
+// The message may carry secrets such as reset tokens and is never logged,
+// the file notifier keeps the full text.
+type LogNotifier struct{}
+
+type FileNotifier struct {
+    mu sync.Mutex
+    path string
+}
+
+func NewNotifier(cfg NotifierConfig) Notifier {
+    if cfg.Kind == "file" && cfg.Path != "" {
+        return &FileNotifier{path: cfg.Path}
+    }
+    return LogNotifier{}
+}
+
+func (LogNotifier) Notify(ctx context.Context, usr *User, subject, message string) error {
+    slog.InfoContext(ctx, "notify", "email", usr.Email, "subject", subject, "length", len(message))
+    return nil
+}
+
+func (fn *FileNotifier) Notify(ctx context.Context, usr *User, subject, message string) error {
+    fn.mu.Lock()
+    defer fn.mu.Unlock()
+
+    f, err := os.OpenFile(fn.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to open notification file", "err", err)
+        return err
+    }
+    defer f.Close()
+
+    _, err = fmt.Fprintf(f, "%s to:%s subject:%s\n%s\n\n", time.Now().Format(time.RFC3339), usr.Email, subject, message)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to write notification", "err", err)
+    }
+    return err
+}
@@ -0,0 +1,427 @@
+package main
+
+import "os"
+import "fmt"
+import "math"
+import "bufio"
+import "embed"
+import "strings"
+import "unicode"
+import "unicode/utf8"
+import "io"
+import "crypto/sha1"
+import "encoding/hex"
+
+//go:embed passwords
+var passwordFiles embed.FS
+
+const hashPrefixLength = 5
+
+// Bcrypt refuses passwords longer than 72 bytes.
+const bcryptMaxLength = 72
+
+// Keyboard rows matched as spatial patterns like qwerty or asdf.
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+var leetSubstitutions = map[rune]rune{
+    '0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '@': 'a', '$': 's', '!': 'i',
+}
+
+// Breached is an optional file of further SHA-1 hashes extending the
+// bundled list, lines of a downloaded HASH:COUNT list are accepted too.
+type PasswordConfig struct {
+    MinLength int `json:"min_length"`
+    MaxLength int `json:"max_length"`
+    MinEntropy int `json:"min_entropy"`
+    Breached string `json:"breached"`
+}
+
+func (pc PasswordConfig) Length() int {
+    if pc.MinLength <= 0 {
+        return 10
+    }
+    return pc.MinLength
+}
+
+// Maximum length in bytes, never above what bcrypt can hash.
+func (pc PasswordConfig) Limit() int {
+    if pc.MaxLength <= 0 || pc.MaxLength > bcryptMaxLength {
+        return bcryptMaxLength
+    }
+    return pc.MaxLength
+}
+
+// Minimum estimated entropy in bits, roughly 10^8 guesses by default.
+func (pc PasswordConfig) Entropy() float64 {
+    if pc.MinEntropy <= 0 {
+        return 27
+    }
+    return float64(pc.MinEntropy)
+}
+
+type PasswordPolicy struct {
+    minLength int
+    maxLength int
+    minEntropy float64
+    words map[string]int
+    longestWord int
+    breached map[string]map[string]bool
+}
+
+// Part of a password explained by a pattern, costing bits of entropy
+// instead of guessing every character on its own.
+type passwordMatch struct {
+    start int
+    end int
+    bits float64
+}
+
+func NewPasswordPolicy(cfg PasswordConfig) (*PasswordPolicy, error) {
+    pp := &PasswordPolicy{
+        minLength: cfg.Length(),
+        maxLength: cfg.Limit(),
+        minEntropy: cfg.Entropy(),
+        words: make(map[string]int),
+        breached: make(map[string]map[string]bool),
+    }
+
+    common, err := passwordFiles.Open("passwords/common.txt")
+    if err != nil {
+        return nil, err
+    }
+    defer common.Close()
+
+    rank := 0
+    if err = readPasswordLines(common, func(word string) {
+        rank++
+        if _, found := pp.words[word]; !found {
+            pp.words[word] = rank
+            pp.longestWord = max(pp.longestWord, utf8.RuneCountInString(word))
+        }
+    }); err != nil {
+        return nil, err
+    }
+
+    breached, err := passwordFiles.Open("passwords/breached.txt")
+    if err != nil {
+        return nil, err
+    }
+    defer breached.Close()
+
+    if err = pp.loadBreached(breached); err != nil {
+        return nil, err
+    }
+
+    if cfg.Breached != "" {
+        f, err := os.Open(cfg.Breached)
+        if err != nil {
+            return nil, err
+        }
+        defer f.Close()
+
+        if err = pp.loadBreached(f); err != nil {
+            return nil, err
+        }
+    }
+    return pp, nil
+}
+
+// Default settings with the bundled lists only, replaced by main once the
+// configuration is loaded. The bundled lists are part of the binary, so
+// failing to read them is a broken build.
+func DefaultPasswordPolicy() *PasswordPolicy {
+    pp, err := NewPasswordPolicy(PasswordConfig{})
+    if err != nil {
+        panic(err)
+    }
+    return pp
+}
+
+func readPasswordLines(r io.Reader, fn func(string)) error {
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        fn(line)
+    }
+    return scanner.Err()
+}
+
+func (pp *PasswordPolicy) loadBreached(r io.Reader) error {
+    return readPasswordLines(r, func(line string) {
+        hash, _, _ := strings.Cut(line, ":")
+        hash = strings.ToUpper(hash)
+        if len(hash) != sha1.Size * 2 {
+            return
+        }
+
+        prefix := hash[:hashPrefixLength]
+        if pp.breached[prefix] == nil {
+            pp.breached[prefix] = make(map[string]bool)
+        }
+        pp.breached[prefix][hash[hashPrefixLength:]] = true
+    })
+}
+
+// Hash suffixes of all breached passwords sharing the prefix, the
+// password itself never leaves Breached.
+func (pp *PasswordPolicy) Range(prefix string) map[string]bool {
+    return pp.breached[strings.ToUpper(prefix)]
+}
+
+func (pp *PasswordPolicy) Breached(password string) bool {
+    sum := sha1.Sum([]byte(password))
+    hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+    return pp.Range(hash[:hashPrefixLength])[hash[hashPrefixLength:]]
+}
+
+// Estimates the entropy in bits similar to zxcvbn: the password is split
+// into dictionary words, repeats, sequences and keyboard runs and the
+// cheapest explanation of all characters is taken. Inputs like username
+// and email count as the most common words.
+func (pp *PasswordPolicy) Entropy(password string, inputs ...string) float64 {
+    var runes = []rune(password)
+    if len(runes) == 0 {
+        return 0
+    }
+
+    var words = make(map[string]int)
+    var longest = pp.longestWord
+    for _, input := range inputs {
+        for _, part := range strings.FieldsFunc(strings.ToLower(input), func(c rune) bool {
+            return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+        }) {
+            words[part] = 1
+            longest = max(longest, utf8.RuneCountInString(part))
+        }
+    }
+
+    var matches []passwordMatch
+    matches = append(matches, pp.dictionaryMatches(runes, words, longest)...)
+    matches = append(matches, repeatMatches(runes)...)
+    matches = append(matches, sequenceMatches(runes)...)
+    matches = append(matches, keyboardMatches(runes)...)
+
+    var ending = make([][]passwordMatch, len(runes) + 1)
+    for _, m := range matches {
+        ending[m.end] = append(ending[m.end], m)
+    }
+
+    var charBits = math.Log2(float64(passwordCardinality(runes)))
+    var best = make([]float64, len(runes) + 1)
+    for i := 1; i <= len(runes); i++ {
+        best[i] = best[i - 1] + charBits
+        for _, m := range ending[i] {
+            if best[m.start] + m.bits < best[i] {
+                best[i] = best[m.start] + m.bits
+            }
+        }
+    }
+    return best[len(runes)]
+}
+
+// Substrings longer than the longest known word can never match, so only
+// those up to longest characters are looked up.
+func (pp *PasswordPolicy) dictionaryMatches(runes []rune, inputs map[string]int, longest int) []passwordMatch {
+    var lower = []rune(strings.ToLower(string(runes)))
+    var plain = make([]rune, len(lower))
+    for i, c := range lower {
+        if sub, found := leetSubstitutions[c]; found {
+            plain[i] = sub
+        } else {
+            plain[i] = c
+        }
+    }
+
+    var matches []passwordMatch
+    for i := 0; i < len(runes); i++ {
+        for j := i + 3; j <= len(runes) && j - i <= longest; j++ {
+            word := string(plain[i:j])
+            rank, found := inputs[word]
+            if !found {
+                rank, found = pp.words[word]
+            }
+            if !found {
+                continue
+            }
+
+            bits := math.Log2(float64(rank)) + uppercaseBits(runes[i:j])
+            if string(lower[i:j]) != word {
+                bits++
+            }
+            matches = append(matches, passwordMatch{start: i, end: j, bits: bits})
+        }
+    }
+    return matches
+}
+
+func uppercaseBits(runes []rune) float64 {
+    var upper, lower int
+    for _, c := range runes {
+        if unicode.IsUpper(c) {
+            upper++
+        } else if unicode.IsLower(c) {
+            lower++
+        }
+    }
+
+    if upper == 0 {
+        return 0
+    } else if lower == 0 || (upper == 1 && unicode.IsUpper(runes[0])) {
+        return 1
+    }
+
+    var combinations float64
+    for k := 1; k <= upper && k <= lower; k++ {
+        combinations += binomial(upper + lower, k)
+    }
+    return math.Log2(combinations)
+}
+
+func binomial(n, k int) float64 {
+    var result = 1.0
+    for i := 1; i <= k; i++ {
+        result = result * float64(n - k + i) / float64(i)
+    }
+    return result
+}
+
+func repeatMatches(runes []rune) []passwordMatch {
+    var matches []passwordMatch
+    for i := 0; i < len(runes); {
+        j := i + 1
+        for j < len(runes) && runes[j] == runes[i] {
+            j++
+        }
+
+        if j - i >= 3 {
+            bits := math.Log2(float64(passwordCardinality(runes[i:i + 1]))) + math.Log2(float64(j - i))
+            matches = append(matches, passwordMatch{start: i, end: j, bits: bits})
+        }
+        i = j
+    }
+    return matches
+}
+
+// Runs like abc, 9876 or XYZ where every character follows the previous
+// one in the same direction.
+func sequenceMatches(runes []rune) []passwordMatch {
+    var matches []passwordMatch
+    for i := 0; i < len(runes) - 2; {
+        delta := runes[i + 1] - runes[i]
+        if delta != 1 && delta != -1 {
+            i++
+            continue
+        }
+
+        j := i + 1
+        for j < len(runes) && runes[j] - runes[j - 1] == delta && sameCharClass(runes[j], runes[i]) {
+            j++
+        }
+
+        if j - i >= 3 {
+            bits := math.Log2(float64(passwordCardinality(runes[i:i + 1])))
+            if strings.ContainsRune("aAzZ09", runes[i]) {
+                bits = 1
+            }
+
+            bits += math.Log2(float64(j - i))
+            if delta < 0 {
+                bits++
+            }
+            matches = append(matches, passwordMatch{start: i, end: j, bits: bits})
+        }
+        i = max(j - 1, i + 1)
+    }
+    return matches
+}
+
+func keyboardMatches(runes []rune) []passwordMatch {
+    var lower = []rune(strings.ToLower(string(runes)))
+    var positions float64
+    var longest int
+    for _, row := range keyboardRows {
+        positions += float64(len(row))
+        longest = max(longest, len(row))
+    }
+
+    var matches []passwordMatch
+    for i := 0; i < len(lower); i++ {
+        for j := i + 4; j <= len(lower) && j - i <= longest; j++ {
+            run := string(lower[i:j])
+            for _, row := range keyboardRows {
+                if strings.Contains(row, run) {
+                    bits := math.Log2(positions) + math.Log2(float64(j - i)) + uppercaseBits(runes[i:j])
+                    matches = append(matches, passwordMatch{start: i, end: j, bits: bits})
+                    break
+                }
+            }
+        }
+    }
+    return matches
+}
+
+func sameCharClass(a, b rune) bool {
+    return (unicode.IsLower(a) && unicode.IsLower(b)) ||
+            (unicode.IsUpper(a) && unicode.IsUpper(b)) ||
+            (unicode.IsDigit(a) && unicode.IsDigit(b))
+}
+
+// Size of the alphabet a brute force attack would have to try.
+func passwordCardinality(runes []rune) int {
+    var lower, upper, digit, symbol, other bool
+    for _, c := range runes {
+        switch {
+        case c >= 'a' && c <= 'z':
+            lower = true
+        case c >= 'A' && c <= 'Z':
+            upper = true
+        case c >= '0' && c <= '9':
+            digit = true
+        case c <= unicode.MaxASCII:
+            symbol = true
+        default:
+            other = true
+        }
+    }
+
+    var cardinality int
+    if lower {
+        cardinality += 26
+    }
+    if upper {
+        cardinality += 26
+    }
+    if digit {
+        cardinality += 10
+    }
+    if symbol {
+        cardinality += 33
+    }
+    if other {
+        cardinality += 100
+    }
+    return cardinality
+}
+
+// Rejections of the policy as field errors, inputs are user data like
+// the username that make a password easier to guess.
+// Overlong passwords are rejected before any estimate is made.
+func (pp *PasswordPolicy) Check(field, password string, inputs ...string) []FieldError {
+    var v = Validation{}
+    if len(password) > pp.maxLength {
+        v.Fail(field, "too_long", fmt.Sprintf("must not be longer than %d bytes", pp.maxLength))
+        return v.fields
+    }
+
+    v.Check(len([]rune(password)) >= pp.minLength, field, "too_short",
+            fmt.Sprintf("must be at least %d characters long", pp.minLength))
+
+    if bits := pp.Entropy(password, inputs...); bits < pp.minEntropy {
+        v.Fail(field, "too_weak", fmt.Sprintf("is too easy to guess, estimated %.0f of %.0f bits", bits, pp.minEntropy))
+    }
+    v.Check(!pp.Breached(password), field, "breached", "appeared in a data breach")
+    return v.fields
+}
@@ -0,0 +1,99 @@
+package main
+
+import "time"
+import "testing"
+import "strings"
+
+func TestPasswordEntropy(t *testing.T) {
+    policy, err := NewPasswordPolicy(PasswordConfig{})
+    if err != nil {
+        t.Fatal("unable to load password policy:", err)
+    }
+
+    cases := []struct {
+        password string
+        inputs []string
+        weak bool
+    }{
+        {password: "password", weak: true},
+        {password: "P4ssw0rd", weak: true},
+        {password: "aaaaaaaaaaaaaaaa", weak: true},
+        {password: "abcdefghijklmnop", weak: true},
+        {password: "qwertyuiop123", weak: true},
+        {password: "dragonmonkey", weak: true},
+        {password: "alicealice", inputs: []string{"alice", "alice@example.com"}, weak: true},
+        {password: "Violet lanterns 4 ever"},
+        {password: "x7#Kq9!mZ2@w"},
+        {password: "Tr0ub4dor&3horse"},
+    }
+
+    for _, tc := range cases {
+        bits := policy.Entropy(tc.password, tc.inputs...)
+        if weak := bits < policy.minEntropy; weak != tc.weak {
+            t.Errorf("%q: estimated %.1f bits, expected weak %v", tc.password, bits, tc.weak)
+        }
+    }
+}
+
+// Estimates are linear in the password length, the policy rejects long
+// passwords anyway but Entropy must not depend on that.
+func TestPasswordEntropyLong(t *testing.T) {
+    policy, err := NewPasswordPolicy(PasswordConfig{})
+    if err != nil {
+        t.Fatal("unable to load password policy:", err)
+    }
+
+    start := time.Now()
+    policy.Entropy(strings.Repeat("password1qwerty", 1000), "alice", "alice@example.com")
+    if elapsed := time.Since(start); elapsed > 5 * time.Second {
+        t.Errorf("estimating a long password took %v", elapsed)
+    }
+}
+
+func TestPasswordPolicy(t *testing.T) {
+    policy, err := NewPasswordPolicy(PasswordConfig{MinLength: 12})
+    if err != nil {
+        t.Fatal("unable to load password policy:", err)
+    }
+
+    if !policy.Breached("password123") || policy.Breached("Violet lanterns 4 ever") {
+        t.Error("unexpected breached password lookup")
+    }
+
+    // 5BAA6 is the prefix of the SHA-1 hash of "password".
+    if suffixes := policy.Range("5baa6"); !suffixes["1E4C9B93F3F0682250B6CF8331B7EE68FD8"] {
+        t.Errorf("expected hash suffix in range, got %d suffixes", len(suffixes))
+    }
+
+    cases := []struct {
+        password string
+        codes []string
+    }{
+        {password: "", codes: []string{"too_short", "too_weak"}},
+        {password: "Password1", codes: []string{"too_short", "too_weak", "breached"}},
+        {password: "correcthorsebatterystaple", codes: []string{"breached"}},
+        {password: "Violet lanterns 4 ever"},
+        {password: strings.Repeat("Violet lanterns 4 ever ", 3) + "!!!!", codes: []string{"too_long"}},
+        {password: strings.Repeat("password", 1 << 20), codes: []string{"too_long"}},
+    }
+
+    for _, tc := range cases {
+        var codes []string
+        for _, field := range policy.Check("password", tc.password) {
+            if field.Field != "password" {
+                t.Errorf("%q: unexpected field %q", tc.password, field.Field)
+            }
+            codes = append(codes, field.Code)
+        }
+
+        if len(codes) != len(tc.codes) {
+            t.Errorf("%q: expected %v, got %v", tc.password, tc.codes, codes)
+            continue
+        }
+        for i := range codes {
+            if codes[i] != tc.codes[i] {
+                t.Errorf("%q: expected %v, got %v", tc.password, tc.codes, codes)
+            }
+        }
+    }
+}
@@ -0,0 +1,88 @@
+package main
+
+import "context"
+import "time"
+
+// Storage behind every endpoint. Handlers only reach the storage through
+// vincaRepository, another backend replaces it by assigning its own
+// implementation. VincaDatabase is the only one shipped, it runs on MySQL
+// and SQLite, the memory driver is a private in-memory SQLite database.
+type Repository interface {
+    Now(ctx context.Context) (Datetime, error)
+    Close() error
+
+    UserSave(ctx context.Context, usr *User) error
+    FetchUser(ctx context.Context, email string) *User
+    FetchUserById(ctx context.Context, uid int) *User
+    FetchUserFromSession(ctx context.Context, session *VincaSession) *User
+    UpdateUser(ctx context.Context, usr *User, params UserParam) error
+    UpdatePassword(ctx context.Context, usr *User) error
+
+    SaveResetToken(ctx context.Context, usr *User, hash []byte, lifetime time.Duration) error
+    FetchResetToken(ctx context.Context, token string) (int, error)
+    ConsumeResetToken(ctx context.Context, token string) (int, error)
+
+    SaveTotpSecret(ctx context.Context, usr *User, secret []byte) error
+    EnableTotp(ctx context.Context, usr *User, codes []string) error
+    DisableTotp(ctx context.Context, usr *User) error
+    ConsumeTotpStep(ctx context.Context, usr *User, step uint64) bool
+    VerifySecondFactor(ctx context.Context, usr *User, code string) bool
+
+    FetchDefaultContainer(ctx context.Context, usr *User) (Container, error)
+    FetchContainers(ctx context.Context, usr *User) ([]Container, error)
+    FetchContainer(ctx context.Context, container *Container, usr *User) error
+    FetchOwnedContainer(ctx context.Context, container *Container, usr *User) error
+    SaveContainer(ctx context.Context, container *Container, usr *User) error
+    RenameContainer(ctx context.Context, container *Container, usr *User) error
+    DestroyContainer(ctx context.Context, container *Container, usr *User) error
+    RotateContainer(ctx context.Context, container *Container, stores []StoreRotation, members []MemberKey, usr *User) error
+
+    FetchSharedContainer(ctx context.Context, container *Container, usr *User) error
+    FetchSharedContainers(ctx context.Context, usr *User) ([]Container, error)
+    FetchContainerUsers(ctx context.Context, container int) []int
+    FetchCategoryUsers(ctx context.Context, category int) []int
+    FetchMembers(ctx context.Context, container *Container) ([]ContainerMember, error)
+    SaveMember(ctx context.Context, container *Container, member *ContainerMember) error
+    DestroyMember(ctx context.Context, container *Container, member *ContainerMember) error
+
+    FetchCategories(ctx context.Context, usr *User) ([]*Category, error)
+    FetchCategory(ctx context.Context, ct *Category, usr *User) error
+    SaveCategory(ctx context.Context, ct *Category, usr *User) error
+    UpdateCategory(ctx context.Context, ct *Category, usr *User) error
+    MigrateCategory(ctx context.Context, ct, migrate *Category, usr *User) error
+    DestroyCategory(ctx context.Context, ct *Category, usr *User) error
+    FetchContainerCategories(ctx context.Context, container *Container, usr *User) ([]*Category, error)
+    CheckStoreCategory(ctx context.Context, st *Store) error
+
+    FetchStores(ctx context.Context, usr *User, sr StoresRequest) ([]Store, error)
+    FetchStoresWith(ctx context.Context, usr *User, params *CategoryRequest) ([]Store, error)
+    FetchStoreHistory(ctx context.Context, usr *User) ([]Store, error)
+    FetchStoreQuery(ctx context.Context, usr *User, sq StoreQuery) ([]Store, error)
+    FetchStoreNames(ctx context.Context, usr *User) ([]string, error)
+    FetchStoreContent(ctx context.Context, usr *User, st *Store) error
+    UpdateStoreUsage(ctx context.Context, usr *User, st *Store)
+    SaveStore(ctx context.Context, usr *User, st *Store) error
+    UpdateStore(ctx context.Context, usr *User, st *Store) error
+    DestroyStore(ctx context.Context, usr *User, st *Store) error
+    StoreWritable(ctx context.Context, usr *User, st *Store) bool
+
+    FetchStoreRevisions(ctx context.Context, usr *User, st *Store) ([]StoreRevision, error)
+    FetchStoreRevision(ctx context.Context, usr *User, rev *StoreRevision) error
+
+    FetchTrash(ctx context.Context, usr *User) ([]TrashedStore, error)
+    RestoreStore(ctx context.Context, usr *User, st *Store) error
+    PurgeStore(ctx context.Context, usr *User, st *Store) error
+    EmptyTrash(ctx context.Context, usr *User) (int, error)
+    PurgeExpiredTrash(ctx context.Context, retention time.Duration)
+
+    FetchTombstones(ctx context.Context, usr *User, since string) ([]Tombstone, error)
+    FetchSyncContainers(ctx context.Context, usr *User, since string) ([]Container, error)
+    FetchSyncCategories(ctx context.Context, usr *User, since string) ([]*Category, error)
+    FetchSyncStores(ctx context.Context, usr *User, since string) ([]Store, error)
+
+    ExportVault(ctx context.Context, usr *User) (*VaultExport, error)
+    ImportVault(ctx context.Context, usr *User, export *VaultExport) (*VaultImportResult, error)
+    ImportStores(ctx context.Context, usr *User, container *Container, entries []ImportStore) (*ImportCommitResult, error)
+}
+
+var _ Repository = (*VincaDatabase)(nil)
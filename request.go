@@ -1,22 +1,53 @@
 package main
 
+import "context"
+import "errors"
+import "database/sql"
 import "encoding/json"
 import "net/http"
+import "net"
 import "strings"
+import "strconv"
 import "sync"
-import "log"
+import "time"
+import "log/slog"
+import "github.com/google/uuid"
 
 const ErrSuccess = "success"
-const ErrSystem = "error"
+
+const corsAllowHeaders = "Content-Type, Origin, Accept, If-Match, Vinca-Authentication"
+const corsExposeHeaders = RequestIdHeader + ", ETag"
 
 var ErrInvalidParams = NewHandlerErr("sys_invalid_params", http.StatusBadRequest)
-var ErrUsedEmail = NewHandlerErr("sys_email_exists", http.StatusBadRequest)
+var ErrUsedEmail = NewHandlerErr("sys_email_exists", http.StatusConflict)
 var ErrInvalidPassword = NewHandlerErr("usr_invalid_pass", http.StatusUnauthorized)
+var ErrStaleWrite = NewHandlerErr("sys_stale_write", http.StatusConflict)
+var ErrVersionRequired = NewHandlerErr("sys_version_required", http.StatusPreconditionRequired)
+var ErrNotFound = NewHandlerErr("sys_not_found", http.StatusNotFound)
+var ErrConflict = NewHandlerErr("sys_conflict", http.StatusConflict)
+var ErrForbidden = NewHandlerErr("sys_forbidden", http.StatusForbidden)
+var ErrInternal = NewHandlerErr("sys_internal", http.StatusInternalServerError)
+var ErrValidation = NewHandlerErr("sys_validation", http.StatusUnprocessableEntity)
+var ErrRequestTooLarge = NewHandlerErr("sys_request_too_large", http.StatusRequestEntityTooLarge)
 
 type RouteHandler func(*Request) interface{}
 
+// Handlers of authenticated routes receive the session user, requests
+// without one are answered with ErrInvalidSession.
+type AuthHandler func(*Request, *User) interface{}
+
 type MiddlewareHandler func(*Request) error
 
+// Responses carrying an ETag header, clients send it back through If-Match.
+type EntityTagger interface {
+    ETag() string
+}
+
+// Handlers returning a ResponseStreamer write the response on their own.
+type ResponseStreamer interface {
+    Stream(http.ResponseWriter, *Request)
+}
+
 type VincaMux struct {
     Cors bool
     mu sync.RWMutex
@@ -25,6 +56,7 @@ type VincaMux struct {
 
 type VincaRoute struct {
     mu sync.Mutex
+    segments []string
     methods []*RouteMethod
     middleware []MiddlewareHandler
 }
@@ -37,12 +69,15 @@ type RouteMethod struct {
 
 type Request struct {
     *http.Request
-    store []RequestStoreParam
+    id string
+    logger *slog.Logger
+    params map[string]string
 }
 
-type RequestStoreParam struct {
-    key interface{}
-    value interface{}
+// Typed key of a value carried in the request context, keys are compared
+// by identity so they must be created once with NewContextKey.
+type ContextKey[T any] struct {
+    name string
 }
 
 type Response struct {
@@ -54,6 +89,19 @@ type Response struct {
 type HandlerErr struct {
     err string
     status int
+    content interface{}
+}
+
+// Single rejected field of a request, Code is machine readable and
+// Message meant for humans.
+type FieldError struct {
+    Field string `json:"field"`
+    Code string `json:"code"`
+    Message string `json:"message,omitempty"`
+}
+
+type ValidationContent struct {
+    Fields []FieldError `json:"fields"`
 }
 
 func NewHandlerErr(err string, status int) *HandlerErr {
@@ -64,8 +112,36 @@ func (err *HandlerErr) Error() string {
     return err.err
 }
 
+// Returns a copy of the error carrying additional response content.
+func (err *HandlerErr) WithContent(content interface{}) *HandlerErr {
+    return &HandlerErr{err: err.err, status: err.status, content: content}
+}
+
+func NewValidationErr(fields ...FieldError) *HandlerErr {
+    return ErrValidation.WithContent(ValidationContent{Fields: fields})
+}
+
+// Maps any error onto the catalogue above. Errors without a HandlerErr
+// become ErrNotFound for missing rows and ErrInternal otherwise, so
+// driver messages never reach the client.
+func AsHandlerErr(err error) *HandlerErr {
+    var hlerr *HandlerErr
+    if errors.As(err, &hlerr) {
+        return hlerr
+    }
+
+    if errors.Is(err, sql.ErrNoRows) {
+        return ErrNotFound
+    }
+    return ErrInternal
+}
+
+func (err *HandlerErr) Status() int {
+    return err.status
+}
+
 func (err *HandlerErr) Response() *Response {
-    return &Response{Status: err.err, statusCode: err.status}
+    return &Response{Status: err.err, Content: err.content, statusCode: err.status}
 }
 
 func (resp *Response) Write(w http.ResponseWriter) {
@@ -75,55 +151,239 @@ func (resp *Response) Write(w http.ResponseWriter) {
     }
 }
 
+// Records the status code written by a handler for the access log.
+type statusWriter struct {
+    http.ResponseWriter
+    status int
+}
+
 func NewRequest(r *http.Request) *Request {
-    return &Request{Request: r}
+    id := NewRequestId()
+    r = r.WithContext(context.WithValue(r.Context(), LogRequestId, id))
+    return &Request{Request: r, id: id, logger: slog.Default().With("request_id", id)}
+}
+
+func (r *Request) Id() string {
+    return r.id
 }
 
+// Logger carrying the request id, used for every line logged while
+// handling the request.
+func (r *Request) Logger() *slog.Logger {
+    return r.logger
+}
+
+// Decodes the request body and validates it when v implements Validator.
+// Unknown fields and mistyped values are rejected with field details.
 func (r *Request) Decode(v interface{}) error {
-    if err := json.NewDecoder(r.Body).Decode(v); err != nil {
-        log.Println("unable to decode:", err)
-        return ErrInvalidParams
+    if err := r.decode(v); err != nil {
+        return err
+    }
+    return validate(v)
+}
+
+func (r *Request) decode(v interface{}) error {
+    dec := json.NewDecoder(r.Body)
+    dec.DisallowUnknownFields()
+
+    err := dec.Decode(v)
+    if err == nil {
+        return nil
+    }
+    r.logger.Info("unable to decode request", "err", err)
+
+    var typeErr *json.UnmarshalTypeError
+    var sizeErr *http.MaxBytesError
+    if errors.As(err, &sizeErr) {
+        return ErrRequestTooLarge
+    } else if errors.As(err, &typeErr) && typeErr.Field != "" {
+        return NewValidationErr(FieldError{Field: typeErr.Field, Code: "type",
+                Message: "must be of type " + typeErr.Type.String()})
+    } else if field, found := strings.CutPrefix(err.Error(), "json: unknown field "); found {
+        return NewValidationErr(FieldError{Field: strings.Trim(field, `"`), Code: "unknown",
+                Message: "is not supported"})
+    }
+    return ErrInvalidParams
+}
+
+func validate(v interface{}) error {
+    if validator, ok := v.(Validator); ok {
+        return validator.Validate()
     }
     return nil
 }
 
-func (r *Request) Value(key interface{}) interface{} {
-    for _, sp := range r.store {
-        if sp.key == key {
-            return sp.value
+// Path parameter of the matched route pattern, such as id for
+// /api/v1/stores/{id}. Empty when the route does not define it.
+func (r *Request) Param(name string) string {
+    return r.params[name]
+}
+
+// Decodes a request addressing a single resource. Routes carrying the
+// resource in an {id} path parameter take the id from the path and the
+// body becomes optional, the older routes send the id in the body.
+func (r *Request) DecodeResource(v interface{}, id *int) error {
+    param := r.Param("id")
+    if param == "" {
+        return r.Decode(v)
+    }
+
+    if r.ContentLength != 0 {
+        if err := r.decode(v); err != nil {
+            return err
         }
     }
-    return nil
+
+    rid, err := strconv.Atoi(param)
+    if err != nil || rid < 1 {
+        return ErrInvalidParams
+    }
+    *id = rid
+    return validate(v)
 }
 
-func (r *Request) WithValue(key, value interface{}) {
-    r.store = append(r.store, RequestStoreParam{key: key, value: value})
+// Integer query parameter, zero when it is missing or malformed.
+func (r *Request) QueryInt(name string) int {
+    value, err := strconv.Atoi(r.URL.Query().Get(name))
+    if err != nil {
+        return 0
+    }
+    return value
 }
 
-func (vm *VincaMux) match(path string) *VincaRoute {
-    log.Println("match route", path)
+func (r *Request) RemoteHost() string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// Version expected by the client, taken from the If-Match header when
+// the request body did not carry one. If-Match uses the strong comparison,
+// weak tags never match.
+func (r *Request) ExpectedVersion(version int) (int, error) {
+    if version > 0 {
+        return version, nil
+    }
+
+    etag := r.Header.Get("If-Match")
+    if etag == "" {
+        return 0, ErrVersionRequired
+    }
+
+    if len(etag) < 2 || etag[0] != '"' || etag[len(etag) - 1] != '"' {
+        return 0, ErrInvalidParams
+    }
 
+    version, err := strconv.Atoi(etag[1:len(etag) - 1])
+    if err != nil || version < 1 {
+        return 0, ErrInvalidParams
+    }
+    return version, nil
+}
+
+func NewContextKey[T any](name string) *ContextKey[T] {
+    return &ContextKey[T]{name: name}
+}
+
+func (key *ContextKey[T]) String() string {
+    return "vinca context key " + key.name
+}
+
+func ContextValue[T any](ctx context.Context, key *ContextKey[T]) (T, bool) {
+    value, ok := ctx.Value(key).(T)
+    return value, ok
+}
+
+// Stores the value in the context of the request, it is visible to every
+// later middleware and the handler.
+func WithContextValue[T any](r *Request, key *ContextKey[T], value T) {
+    r.Request = r.Request.WithContext(context.WithValue(r.Context(), key, value))
+}
+
+// User of the authenticated session, nil on routes without auth_middleware.
+func (r *Request) User() *User {
+    usr, _ := ContextValue(r.Context(), AuthSessionUser)
+    return usr
+}
+
+func (r *Request) SessionId() uuid.UUID {
+    suid, _ := ContextValue(r.Context(), AuthSessionId)
+    return suid
+}
+
+// Static routes are looked up first, then route patterns with the most
+// literal segments, and at last the longest route being a path prefix.
+func (vm *VincaMux) match(path string) (*VincaRoute, map[string]string) {
     vm.mu.RLock()
     defer vm.mu.RUnlock()
 
-    log.Println("matching static paths for", path)
-    if r, ok := vm.routes[path]; ok {
-        log.Println("found static route", r)
-        return r
+    if r, ok := vm.routes[path]; ok && r.segments == nil {
+        return r, nil
     }
 
-    log.Println("mathing prefix for", path)
+    var segments = strings.Split(strings.Trim(path, "/"), "/")
+    var match *VincaRoute
+    var params map[string]string
+    var literals = -1
+    for _, r := range vm.routes {
+        if r.segments == nil {
+            continue
+        }
+
+        if found, n := r.matchSegments(segments); found != nil && n > literals {
+            match, params, literals = r, found, n
+        }
+    }
+    if match != nil {
+        return match, params
+    }
+
+    var prefix string
     for p, r := range vm.routes {
-        if strings.HasPrefix(path, p) {
-            log.Println("match found", p)
-            return r
+        if r.segments != nil || len(p) <= len(prefix) {
+            continue
+        }
+
+        if strings.HasPrefix(path, strings.TrimSuffix(p, "/") + "/") {
+            match, prefix = r, p
         }
     }
-    return nil
+    return match, nil
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+    sw.status = status
+    sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Flush() {
+    if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+        flusher.Flush()
+    }
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+    return sw.ResponseWriter
 }
 
 func (vm *VincaMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-    route := vm.match(r.URL.Path)
+    var start = time.Now()
+    var req = NewRequest(r)
+    var sw = &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+    sw.Header().Set(RequestIdHeader, req.Id())
+    vm.serve(sw, req)
+
+    req.Logger().Info("request", "method", r.Method, "path", r.URL.Path,
+            "status", sw.status, "duration", time.Since(start))
+}
+
+func (vm *VincaMux) serve(w http.ResponseWriter, req *Request) {
+    var r = req.Request
+
+    route, params := vm.match(r.URL.Path)
     if route == nil {
         http.Error(w, "route not defined", http.StatusNotFound)
         return
@@ -131,12 +391,13 @@ func (vm *VincaMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
     if vm.Cors {
         w.Header().Set("Access-Control-Allow-Origin", "*")
+        w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
         if r.Method == "OPTIONS" {
             header := w.Header()
             header.Add("Vary", "Origin")
             header.Add("Vary", "Access-Control-Request-Method")
             header.Add("Vary", "Access-Control-Request-Headers")
-            header.Add("Access-Control-Allow-Headers", "Content-Type, Origin, Accept, Vinca-Authentication")
+            header.Add("Access-Control-Allow-Headers", corsAllowHeaders)
             header.Add("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
             return
         }
@@ -148,48 +409,71 @@ func (vm *VincaMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    var req = NewRequest(r)
+    req.params = params
+    r.Body = http.MaxBytesReader(w, r.Body, vincaConfig.Limits.BodyLimit())
     for _, mid := range route.middleware {
         if err := mid(req); err != nil {
-            if hlerr, valid := err.(*HandlerErr); valid {
-                hlerr.Response().Write(w)
-                return
-            }
-            w.WriteHeader(http.StatusInternalServerError)
-            json.NewEncoder(w).Encode(Response{Status: ErrSystem, Content: err.Error()})
+            writeError(w, req, err)
             return
         }
     }
 
     for _, mid := range r_method.middleware {
         if err := mid(req); err != nil {
-            if hlerr, valid := err.(*HandlerErr); valid {
-                hlerr.Response().Write(w)
-                return
-            }
-            w.WriteHeader(http.StatusInternalServerError)
-            json.NewEncoder(w).Encode(Response{Status: ErrSystem, Content: err.Error()})
+            writeError(w, req, err)
             return
         }
     }
 
     resp := r_method.handler(req)
-    if err, valid := resp.(*HandlerErr); valid {
-        log.Println(r.URL.Path, err.Error())
-        err.Response().Write(w)
+    if stream, valid := resp.(ResponseStreamer); valid {
+        stream.Stream(w, req)
         return
     }
     if err, valid := resp.(error); valid {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(Response{Status: ErrSystem, Content: err.Error()})
+        writeError(w, req, err)
         return
     }
+    setETag(w, resp)
     w.WriteHeader(http.StatusOK)
-    json.NewEncoder(w).Encode(Response{Status: "success", Content: resp})
+    json.NewEncoder(w).Encode(Response{Status: ErrSuccess, Content: resp})
 }
 
+// Errors outside of the catalogue are logged with their cause and answered
+// with the generic catalogue entry only.
+func writeError(w http.ResponseWriter, req *Request, err error) {
+    var hlerr *HandlerErr
+    if !errors.As(err, &hlerr) {
+        hlerr = AsHandlerErr(err)
+        req.Logger().Error("request failed", "error", hlerr.err, "status", hlerr.status, "err", err)
+    } else if hlerr.status >= http.StatusInternalServerError {
+        req.Logger().Error("request failed", "error", hlerr.err, "status", hlerr.status)
+    } else {
+        req.Logger().Info("request failed", "error", hlerr.err, "status", hlerr.status)
+    }
+    setETag(w, hlerr.content)
+    hlerr.Response().Write(w)
+}
+
+// Stale writes carry the current server copy, its tag is set as well.
+func setETag(w http.ResponseWriter, content interface{}) {
+    if tagged, valid := content.(EntityTagger); valid {
+        w.Header().Set("ETag", tagged.ETag())
+    }
+}
+
+// Strong entity tag of a version counter.
+func VersionETag(version int) string {
+    return "\"" + strconv.Itoa(version) + "\""
+}
+
+// Paths may contain parameter segments like /api/v1/stores/{id}, which
+// are available to handlers through Request.Param.
 func (vm *VincaMux) NewRoute(path string) *VincaRoute {
     var route = &VincaRoute{}
+    if strings.Contains(path, "{") {
+        route.segments = strings.Split(strings.Trim(path, "/"), "/")
+    }
 
     vm.mu.Lock()
     defer vm.mu.Unlock()
@@ -206,6 +490,32 @@ func (vm *VincaMux) NewRoute(path string) *VincaRoute {
     return route
 }
 
+// Returns the path parameters and the count of literal segments when
+// the pattern matches, nil otherwise.
+func (vr *VincaRoute) matchSegments(segments []string) (map[string]string, int) {
+    if len(segments) != len(vr.segments) {
+        return nil, 0
+    }
+
+    var params = make(map[string]string)
+    var literals int
+    for i, seg := range vr.segments {
+        if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+            if segments[i] == "" {
+                return nil, 0
+            }
+            params[seg[1:len(seg) - 1]] = segments[i]
+            continue
+        }
+
+        if seg != segments[i] {
+            return nil, 0
+        }
+        literals++
+    }
+    return params, literals
+}
+
 func (vr *VincaRoute) match(method string) *RouteMethod {
     if len(vr.methods) < 1 {
         return nil
@@ -235,6 +545,16 @@ func (vr *VincaRoute) Handle(h RouteHandler, m string) *VincaRoute {
     return vr
 }
 
+func (vr *VincaRoute) HandleAuth(h AuthHandler, m string) *VincaRoute {
+    return vr.Handle(func(r *Request) interface{} {
+        usr := r.User()
+        if usr == nil {
+            return ErrInvalidSession
+        }
+        return h(r, usr)
+    }, m)
+}
+
 func (vr *VincaRoute) Middleware(middleware ...MiddlewareHandler) *VincaRoute {
     vr.mu.Lock()
     defer vr.mu.Unlock()
@@ -260,7 +580,7 @@ func CorsFunc(handler http.HandlerFunc) http.HandlerFunc {
         headers.Add("Vary", "Origin")
         headers.Add("Vary", "Access-Control-Request-Method")
         headers.Add("Vary", "Access-Control-Request-Headers")
-        headers.Add("Access-Control-Allow-Headers", "Content-Type, Origin, Accept, Vinca-Authentication")
+        headers.Add("Access-Control-Allow-Headers", corsAllowHeaders)
         headers.Add("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
     }
 }
@@ -0,0 +1,171 @@
+package main
+
+import "fmt"
+import "errors"
+import "strings"
+import "database/sql"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+
+func TestMuxMatch(t *testing.T) {
+    var mux = &VincaMux{}
+    var routes = map[string]*VincaRoute{}
+    for _, path := range []string{
+        "/api/v1/stores",
+        "/api/v1/stores/search",
+        "/api/v1/stores/{id}",
+        "/api/v1/stores/{id}/revisions",
+        "/api/v1/stores/{id}/{field}",
+        "/api/v1/home",
+        "/api/v1/home/store",
+    } {
+        routes[path] = mux.NewRoute(path)
+    }
+
+    var tests = []struct {
+        path string
+        route string
+        params map[string]string
+    }{
+        {"/api/v1/stores", "/api/v1/stores", nil},
+        {"/api/v1/stores/search", "/api/v1/stores/search", nil},
+        {"/api/v1/stores/12", "/api/v1/stores/{id}", map[string]string{"id": "12"}},
+        {"/api/v1/stores/12/revisions", "/api/v1/stores/{id}/revisions", map[string]string{"id": "12"}},
+        {"/api/v1/stores/12/name", "/api/v1/stores/{id}/{field}", map[string]string{"id": "12", "field": "name"}},
+        {"/api/v1/home/store/extra", "/api/v1/home/store", nil},
+        {"/api/v1/home/other", "/api/v1/home", nil},
+        {"/api/v1/homeless", "", nil},
+        {"/api/v1/stores//revisions", "/api/v1/stores", nil},
+    }
+
+    for _, tt := range tests {
+        route, params := mux.match(tt.path)
+        if route != routes[tt.route] {
+            t.Errorf("%s: expected route %q", tt.path, tt.route)
+            continue
+        }
+
+        if len(params) != len(tt.params) {
+            t.Errorf("%s: expected params %v, got %v", tt.path, tt.params, params)
+        }
+        for name, value := range tt.params {
+            if params[name] != value {
+                t.Errorf("%s: expected %s=%s, got %q", tt.path, name, value, params[name])
+            }
+        }
+    }
+}
+
+func TestHandleAuthRequiresUser(t *testing.T) {
+    var mux = &VincaMux{}
+    var setUser = func(r *Request) error {
+        if r.Header.Get("Vinca-Authentication") != "" {
+            WithContextValue(r, AuthSessionUser, &User{Id: 7})
+        }
+        return nil
+    }
+    mux.NewRoute("/user").Middleware(setUser).HandleAuth(func(r *Request, usr *User) interface{} {
+        return usr.Id
+    }, "GET")
+
+    var tests = []struct {
+        token string
+        status int
+        body string
+    }{
+        {"", http.StatusUnauthorized, `{"status":"user_session_invalid"}`},
+        {"valid", http.StatusOK, `{"status":"success","content":7}`},
+    }
+
+    for _, tt := range tests {
+        req := httptest.NewRequest("GET", "/user", nil)
+        req.Header.Set("Vinca-Authentication", tt.token)
+
+        w := httptest.NewRecorder()
+        mux.ServeHTTP(w, req)
+        if w.Code != tt.status || strings.TrimSpace(w.Body.String()) != tt.body {
+            t.Errorf("token %q: expected %d %s, got %d %s", tt.token, tt.status, tt.body, w.Code, w.Body.String())
+        }
+    }
+}
+
+func TestContextValue(t *testing.T) {
+    var other = NewContextKey[*User]("other user")
+    var r = NewRequest(httptest.NewRequest("GET", "/", nil))
+
+    if r.User() != nil {
+        t.Fatal("expected no user on a fresh request")
+    }
+
+    WithContextValue(r, AuthSessionUser, &User{Id: 3})
+    if usr := r.User(); usr == nil || usr.Id != 3 {
+        t.Errorf("unexpected session user: %v", usr)
+    }
+
+    if _, ok := ContextValue(r.Context(), other); ok {
+        t.Error("keys with the same type must not collide")
+    }
+}
+
+func TestErrorEnvelope(t *testing.T) {
+    var tests = []struct {
+        name string
+        err error
+        status int
+        body string
+    }{
+        {"driver error", errors.New("Error 1045: access denied for user 'vinca'"),
+            http.StatusInternalServerError, `{"status":"sys_internal"}`},
+        {"missing row", fmt.Errorf("fetch store: %w", sql.ErrNoRows),
+            http.StatusNotFound, `{"status":"sys_not_found"}`},
+        {"catalogue", ErrForbidden, http.StatusForbidden, `{"status":"sys_forbidden"}`},
+        {"wrapped catalogue", fmt.Errorf("rotate: %w", ErrRotationIncomplete),
+            http.StatusConflict, `{"status":"container_rotation_incomplete"}`},
+        {"validation", NewValidationErr(FieldError{Field: "name", Code: "required"}),
+            http.StatusUnprocessableEntity, `{"status":"sys_validation","content":{"fields":[{"field":"name","code":"required"}]}}`},
+    }
+
+    for _, tt := range tests {
+        var mux = &VincaMux{}
+        mux.NewRoute("/fail").Handle(func(r *Request) interface{} {
+            return tt.err
+        }, "GET")
+
+        w := httptest.NewRecorder()
+        mux.ServeHTTP(w, httptest.NewRequest("GET", "/fail", nil))
+        if w.Code != tt.status || strings.TrimSpace(w.Body.String()) != tt.body {
+            t.Errorf("%s: expected %d %s, got %d %s", tt.name, tt.status, tt.body, w.Code, w.Body.String())
+        }
+    }
+}
+
+func TestExpectedVersion(t *testing.T) {
+    cases := []struct {
+        ifMatch string
+        body int
+        version int
+        err error
+    }{
+        {body: 4, version: 4},
+        {ifMatch: `"7"`, body: 4, version: 4},
+        {ifMatch: `"7"`, version: 7},
+        {err: ErrVersionRequired},
+        {ifMatch: `W/"7"`, err: ErrInvalidParams},
+        {ifMatch: `7`, err: ErrInvalidParams},
+        {ifMatch: `"0"`, err: ErrInvalidParams},
+        {ifMatch: `"`, err: ErrInvalidParams},
+    }
+
+    for _, tc := range cases {
+        r := httptest.NewRequest("PATCH", "/api/v1/stores/1", nil)
+        if tc.ifMatch != "" {
+            r.Header.Set("If-Match", tc.ifMatch)
+        }
+
+        version, err := NewRequest(r).ExpectedVersion(tc.body)
+        if err != tc.err || version != tc.version {
+            t.Errorf("If-Match %q, body %d: expected %d %v, got %d %v", tc.ifMatch, tc.body, tc.version, tc.err, version, err)
+        }
+    }
+}
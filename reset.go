@@ -0,0 +1,79 @@
+package main
+
+import "context"
+import "log/slog"
+import "time"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/hex"
+
+// Reset tokens are handed out only once, the database keeps just their hash.
+func NewResetToken() (string, []byte, error) {
+    var buf = make([]byte, 32)
+    if _, err := rand.Read(buf); err != nil {
+        return "", nil, err
+    }
+
+    token := hex.EncodeToString(buf)
+    return token, HashResetToken(token), nil
+}
+
+func HashResetToken(token string) []byte {
+    sum := sha256.Sum256([]byte(token))
+    return sum[:]
+}
+
+func (v *VincaDatabase) SaveResetToken(ctx context.Context, usr *User, hash []byte, lifetime time.Duration) error {
+    if _, err := v.db.Exec("delete from password_resets where user_id = ?", usr.Id); err != nil {
+        slog.ErrorContext(ctx, "unable to remove previous reset tokens", "err", err)
+        return err
+    }
+
+    _, err := v.db.Exec("insert into password_resets(user_id, token, expires) values(?,?,?)",
+            usr.Id, hash, time.Now().UTC().Add(lifetime))
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to save reset token", "err", err)
+        return err
+    }
+    return nil
+}
+
+// Looks up the user id of a valid token without consuming it, so a rejected
+// password does not burn the token.
+func (v *VincaDatabase) FetchResetToken(ctx context.Context, token string) (int, error) {
+    var uid int
+    var expires Datetime
+
+    err := v.db.QueryRow("select user_id, expires from password_resets where token = ?", HashResetToken(token)).Scan(&uid, &expires)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch reset token", "err", err)
+        return 0, ErrInvalidResetToken
+    }
+
+    if time.Now().UTC().After(time.Time(expires)) {
+        slog.InfoContext(ctx, "reset token expired", "user", uid)
+        return 0, ErrInvalidResetToken
+    }
+    return uid, nil
+}
+
+// Consumes the token and returns the owning user id, the token is removed
+// before anything else so a second request with the same token fails.
+func (v *VincaDatabase) ConsumeResetToken(ctx context.Context, token string) (int, error) {
+    uid, err := v.FetchResetToken(ctx, token)
+    if err != nil {
+        return 0, err
+    }
+
+    res, err := v.db.Exec("delete from password_resets where token = ?", HashResetToken(token))
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to consume reset token", "err", err)
+        return 0, err
+    }
+
+    if rows, err := res.RowsAffected(); err != nil || rows != 1 {
+        slog.InfoContext(ctx, "reset token already consumed")
+        return 0, ErrInvalidResetToken
+    }
+    return uid, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import "context"
+import "log/slog"
+import "net/http"
+import "database/sql"
+
+var ErrInvalidRevision = NewHandlerErr("store_revision_invalid", http.StatusNotFound)
+
+type StoreRevision struct {
+    Id int `json:"id"`
+    StoreId int `json:"store_id"`
+    Created Datetime `json:"created"`
+    Name string `json:"name"`
+    Description string `json:"description"`
+    Icon int `json:"icon"`
+    Color int `json:"color"`
+    Content []byte `json:"content,omitempty"`
+}
+
+// Removes everything but the newest keep revisions of the store.
+func PruneStoreRevisions(ctx context.Context, tx *sql.Tx, storeId, keep int) error {
+    var oldest int
+    err := tx.QueryRow("select id from store_revisions where store_id = ? order by id desc limit 1 offset ?", storeId, keep - 1).Scan(&oldest)
+    if err == sql.ErrNoRows {
+        return nil
+    } else if err != nil {
+        slog.ErrorContext(ctx, "unable to find revisions to prune", "err", err)
+        return err
+    }
+
+    if _, err = tx.Exec("delete from store_revisions where store_id = ? and id < ?", storeId, oldest); err != nil {
+        slog.ErrorContext(ctx, "unable to prune store revisions", "err", err)
+        return err
+    }
+    return nil
+}
+
+// Lists the revisions of a readable store, newest first and without content.
+func (v *VincaDatabase) FetchStoreRevisions(ctx context.Context, usr *User, st *Store) ([]StoreRevision, error) {
+    rows, err := v.db.Query("select r.id, r.store_id, r.created, r.name, r.description, r.icon, r.color from store_revisions r join stores s on s.id = r.store_id where r.store_id = ? and s.deleted_at is null and " + sqlStoreReadable + " order by r.id desc",
+            st.Id, usr.Id, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch store revisions", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var revisions = []StoreRevision{}
+    for rows.Next() {
+        var rev = StoreRevision{}
+        if err = rows.Scan(&rev.Id, &rev.StoreId, &rev.Created, &rev.Name, &rev.Description, &rev.Icon, &rev.Color); err != nil {
+            slog.ErrorContext(ctx, "unable to scan store revision", "err", err)
+            continue
+        }
+        revisions = append(revisions, rev)
+    }
+    return revisions, nil
+}
+
+func (v *VincaDatabase) FetchStoreRevision(ctx context.Context, usr *User, rev *StoreRevision) error {
+    err := v.db.QueryRow("select r.created, r.name, r.description, r.icon, r.color, r.content from store_revisions r join stores s on s.id = r.store_id where r.id = ? and r.store_id = ? and s.deleted_at is null and " + sqlStoreReadable,
+            rev.Id, rev.StoreId, usr.Id, usr.Id).Scan(&rev.Created, &rev.Name, &rev.Description, &rev.Icon, &rev.Color, &rev.Content)
+    if err == sql.ErrNoRows {
+        return ErrInvalidRevision
+    } else if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch store revision", "err", err)
+        return err
+    }
+    return nil
+}
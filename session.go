@@ -1,39 +1,331 @@
 package main
 
-import "log"
+import "context"
+import "log/slog"
+import "sync"
+import "time"
+import "crypto/sha256"
+import "encoding/hex"
+import "database/sql"
 import "github.com/google/uuid"
 
 type VincaSession struct {
     userid int
+    created time.Time
+    lastSeen time.Time
+    remoteAddr string
+    userAgent string
 }
 
-type SessionContainer map[uuid.UUID]*VincaSession
+// Public view of a session, the Id is derived from the session uuid
+// so the bearer token itself never leaves the server.
+type SessionInfo struct {
+    Id string `json:"id"`
+    Current bool `json:"current"`
+    Created time.Time `json:"created"`
+    LastSeen time.Time `json:"last_seen"`
+    RemoteAddr string `json:"remote_addr"`
+    UserAgent string `json:"user_agent"`
+}
+
+type SessionContainer interface {
+    CreateSession(ctx context.Context, usr *User, remoteAddr, userAgent string) uuid.UUID
+    SessionUser(ctx context.Context, suid uuid.UUID) *User
+    UserSessions(ctx context.Context, userid int) map[uuid.UUID]*VincaSession
+    RemoveSession(ctx context.Context, suid uuid.UUID) int
+    RemoveUserSessions(ctx context.Context, userid int, keep uuid.UUID) int
+    Reap()
+}
+
+type MemorySessions struct {
+    mu sync.Mutex
+    sessions map[uuid.UUID]*VincaSession
+    idle time.Duration
+    lifetime time.Duration
+}
+
+type DatabaseSessions struct {
+    db *VincaDatabase
+    idle time.Duration
+    lifetime time.Duration
+}
+
+// Database sessions are kept in the sessions table of db.
+func NewSessionContainer(cfg SessionConfig, db *VincaDatabase) SessionContainer {
+    var sc SessionContainer
+    if cfg.Storage == "database" {
+        sc = &DatabaseSessions{db: db, idle: cfg.Idle(), lifetime: cfg.MaxLifetime()}
+    } else {
+        sc = NewMemorySessions(cfg.Idle(), cfg.MaxLifetime())
+    }
+
+    go func() {
+        ticker := time.NewTicker(cfg.Interval())
+        defer ticker.Stop()
+
+        for range ticker.C {
+            sc.Reap()
+        }
+    }()
+    return sc
+}
+
+func (s *VincaSession) Expired(now time.Time, idle, lifetime time.Duration) bool {
+    return now.Sub(s.lastSeen) > idle || now.Sub(s.created) > lifetime
+}
+
+func (s *VincaSession) Info(suid uuid.UUID) SessionInfo {
+    return SessionInfo{
+        Id: SessionPublicId(suid),
+        Created: s.created,
+        LastSeen: s.lastSeen,
+        RemoteAddr: s.remoteAddr,
+        UserAgent: s.userAgent,
+    }
+}
 
-func (sc SessionContainer) CreateSession(usr *User) uuid.UUID {
-    log.Println("create session for user")
+func SessionPublicId(suid uuid.UUID) string {
+    sum := sha256.Sum256(suid[:])
+    return hex.EncodeToString(sum[:8])
+}
+
+func NewMemorySessions(idle, lifetime time.Duration) *MemorySessions {
+    return &MemorySessions{
+        sessions: make(map[uuid.UUID]*VincaSession),
+        idle: idle,
+        lifetime: lifetime,
+    }
+}
+
+func (ms *MemorySessions) CreateSession(ctx context.Context, usr *User, remoteAddr, userAgent string) uuid.UUID {
     suid, err := uuid.NewRandom()
     if err != nil {
-        log.Println("unable to create session uuid:", err)
+        slog.ErrorContext(ctx, "unable to create session uuid", "err", err)
         return uuid.Nil
     }
 
-    sc[suid] = &VincaSession{
+    now := time.Now()
+    ms.mu.Lock()
+    ms.sessions[suid] = &VincaSession{
         userid: usr.Id,
+        created: now,
+        lastSeen: now,
+        remoteAddr: remoteAddr,
+        userAgent: userAgent,
     }
+    ms.mu.Unlock()
+
     return suid
 }
 
-func (sc SessionContainer) SessionUser(suid uuid.UUID) *User {
-    session, valid := sc[suid]
+func (ms *MemorySessions) SessionUser(ctx context.Context, suid uuid.UUID) *User {
+    now := time.Now()
+
+    ms.mu.Lock()
+    session, valid := ms.sessions[suid]
+    if valid && session.Expired(now, ms.idle, ms.lifetime) {
+        delete(ms.sessions, suid)
+        valid = false
+    }
+    if valid {
+        session.lastSeen = now
+    }
+    ms.mu.Unlock()
+
     if !valid {
-        log.Println("unable to find session:", suid)
+        slog.DebugContext(ctx, "unable to find session", "session", SessionPublicId(suid))
         return nil
     }
 
-    usr := vincaDatabase.FetchUserFromSession(session)
+    usr := vincaRepository.FetchUserFromSession(ctx, session)
     if usr == nil {
-        log.Println("invalid user for session:", suid)
+        slog.WarnContext(ctx, "invalid user for session", "session", SessionPublicId(suid))
         return nil
     }
     return usr
 }
+
+func (ms *MemorySessions) UserSessions(ctx context.Context, userid int) map[uuid.UUID]*VincaSession {
+    now := time.Now()
+    var sessions = make(map[uuid.UUID]*VincaSession)
+
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    for suid, session := range ms.sessions {
+        if session.userid == userid && !session.Expired(now, ms.idle, ms.lifetime) {
+            var copied = *session
+            sessions[suid] = &copied
+        }
+    }
+    return sessions
+}
+
+func (ms *MemorySessions) RemoveSession(ctx context.Context, suid uuid.UUID) int {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    if _, ok := ms.sessions[suid]; !ok {
+        return 0
+    }
+    delete(ms.sessions, suid)
+    return 1
+}
+
+func (ms *MemorySessions) RemoveUserSessions(ctx context.Context, userid int, keep uuid.UUID) int {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    var removed int
+    for suid, session := range ms.sessions {
+        if session.userid == userid && suid != keep {
+            delete(ms.sessions, suid)
+            removed++
+        }
+    }
+    return removed
+}
+
+func (ms *MemorySessions) Reap() {
+    now := time.Now()
+
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    for suid, session := range ms.sessions {
+        if session.Expired(now, ms.idle, ms.lifetime) {
+            delete(ms.sessions, suid)
+        }
+    }
+}
+
+func (ds *DatabaseSessions) CreateSession(ctx context.Context, usr *User, remoteAddr, userAgent string) uuid.UUID {
+    suid, err := uuid.NewRandom()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to create session uuid", "err", err)
+        return uuid.Nil
+    }
+
+    now := time.Now().UTC()
+    _, err = ds.db.db.Exec("insert into sessions(id, user_id, created, last_seen, remote_addr, user_agent) values(?,?,?,?,?,?)",
+            suid.String(), usr.Id, now, now, remoteAddr, userAgent)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to save session", "err", err)
+        return uuid.Nil
+    }
+    return suid
+}
+
+func (ds *DatabaseSessions) SessionUser(ctx context.Context, suid uuid.UUID) *User {
+    var session = VincaSession{}
+    var created, lastSeen Datetime
+
+    err := ds.db.db.QueryRow("select user_id, created, last_seen from sessions where id = ?", suid.String()).Scan(
+        &session.userid, &created, &lastSeen,
+    )
+    if err == sql.ErrNoRows {
+        slog.DebugContext(ctx, "unable to find session", "session", SessionPublicId(suid))
+        return nil
+    } else if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch session", "err", err)
+        return nil
+    }
+    session.created = time.Time(created)
+    session.lastSeen = time.Time(lastSeen)
+
+    now := time.Now().UTC()
+    if session.Expired(now, ds.idle, ds.lifetime) {
+        if _, err = ds.db.db.Exec("delete from sessions where id = ?", suid.String()); err != nil {
+            slog.ErrorContext(ctx, "unable to remove expired session", "err", err)
+        }
+        return nil
+    }
+
+    if _, err = ds.db.db.Exec("update sessions set last_seen = ? where id = ?", now, suid.String()); err != nil {
+        slog.ErrorContext(ctx, "unable to update session last_seen", "err", err)
+    }
+
+    usr := ds.db.FetchUserFromSession(ctx, &session)
+    if usr == nil {
+        slog.WarnContext(ctx, "invalid user for session", "session", SessionPublicId(suid))
+        return nil
+    }
+    return usr
+}
+
+func (ds *DatabaseSessions) UserSessions(ctx context.Context, userid int) map[uuid.UUID]*VincaSession {
+    now := time.Now().UTC()
+    rows, err := ds.db.db.Query("select id, created, last_seen, remote_addr, user_agent from sessions where user_id = ? and last_seen >= ? and created >= ?",
+            userid, now.Add(-ds.idle), now.Add(-ds.lifetime))
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch user sessions", "err", err)
+        return nil
+    }
+    defer rows.Close()
+
+    var sessions = make(map[uuid.UUID]*VincaSession)
+    for rows.Next() {
+        var sid string
+        var created, lastSeen Datetime
+        var session = &VincaSession{userid: userid}
+
+        if err = rows.Scan(&sid, &created, &lastSeen, &session.remoteAddr, &session.userAgent); err != nil {
+            slog.ErrorContext(ctx, "unable to scan session", "err", err)
+            continue
+        }
+
+        suid, err := uuid.Parse(sid)
+        if err != nil {
+            slog.ErrorContext(ctx, "invalid session id in database", "err", err)
+            continue
+        }
+        session.created = time.Time(created)
+        session.lastSeen = time.Time(lastSeen)
+        sessions[suid] = session
+    }
+    return sessions
+}
+
+func (ds *DatabaseSessions) RemoveSession(ctx context.Context, suid uuid.UUID) int {
+    res, err := ds.db.db.Exec("delete from sessions where id = ?", suid.String())
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to remove session", "err", err)
+        return 0
+    }
+
+    rows, err := res.RowsAffected()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch removed session count", "err", err)
+        return 0
+    }
+    return int(rows)
+}
+
+func (ds *DatabaseSessions) RemoveUserSessions(ctx context.Context, userid int, keep uuid.UUID) int {
+    res, err := ds.db.db.Exec("delete from sessions where user_id = ? and id != ?", userid, keep.String())
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to remove user sessions", "err", err)
+        return 0
+    }
+
+    rows, err := res.RowsAffected()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch removed sessions count", "err", err)
+        return 0
+    }
+    return int(rows)
+}
+
+func (ds *DatabaseSessions) Reap() {
+    now := time.Now().UTC()
+    res, err := ds.db.db.Exec("delete from sessions where last_seen < ? or created < ?",
+            now.Add(-ds.idle), now.Add(-ds.lifetime))
+    if err != nil {
+        slog.Error("unable to reap expired sessions", "err", err)
+        return
+    }
+
+    if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+        slog.Info("reaped expired sessions", "count", rows)
+    }
+}
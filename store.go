@@ -1,10 +1,12 @@
 package main
 
-import "log"
+import "context"
+import "log/slog"
 import "database/sql"
 
 type Store struct {
     Id int `json:"id"`
+    Version int `json:"version"`
     Created Datetime `json:"created"`
     LastUsed Datetime `json:"last_used"`
     Modified Datetime `json:"modified"`
@@ -21,15 +23,32 @@ type StoreParam struct {
     Color int `json:"color"`
 }
 
+// Requests addressing a store by id, the rest of the store is ignored.
+type StoreReference struct {
+    Store
+}
+
+func (st Store) ETag() string {
+    return VersionETag(st.Version)
+}
+
 type StoreQuery struct {
     Query string `json:"query"`
+    Container int `json:"container,omitempty"`
 }
 
-func (v *VincaDatabase) FetchStores(usr *User, sr StoresRequest) []Store {
-    rows, err := v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color from stores where user_id = ? and category_id = ? order by name asc", usr.Id, sr.Category)
+func (v *VincaDatabase) FetchStores(ctx context.Context, usr *User, sr StoresRequest) ([]Store, error) {
+    var query = "select id, container_id, category_id, created, last_used, modified, name, description, icon, color, version from stores where " + sqlStoreReadable + " and deleted_at is null and category_id = ?"
+    var args = []interface{}{usr.Id, usr.Id, sr.Category}
+    if sr.Container != 0 {
+        query += " and container_id = ?"
+        args = append(args, sr.Container)
+    }
+
+    rows, err := v.db.Query(query + " order by name asc", args...)
     if err != nil {
-        log.Println("unable to fetch stores:", err)
-        return nil
+        slog.ErrorContext(ctx, "unable to fetch stores", "err", err)
+        return nil, err
     }
 
     var stores []Store
@@ -37,35 +56,41 @@ func (v *VincaDatabase) FetchStores(usr *User, sr StoresRequest) []Store {
         var st = Store{}
         err = rows.Scan(&st.Id, &st.Container, &st.Category,
                         &st.Created, &st.LastUsed, &st.Modified,
-                        &st.Name, &st.Description, &st.Icon, &st.Color)
+                        &st.Name, &st.Description, &st.Icon, &st.Color, &st.Version)
         if err != nil {
-            log.Println("unable to scan single store:", err)
+            slog.ErrorContext(ctx, "unable to scan single store", "err", err)
             continue
         }
         stores = append(stores, st)
     }
 
-    log.Println("fetch stories for", usr.Username)
-    return stores
+    return stores, nil
 }
 
-func (v *VincaDatabase) FetchStoresWith(usr *User, params *CategoryRequest) []Store {
+func (v *VincaDatabase) FetchStoresWith(ctx context.Context, usr *User, params *CategoryRequest) ([]Store, error) {
     var rows *sql.Rows = nil
     var err error = nil
 
+    var filter = ""
+    var args = []interface{}{usr.Id, usr.Id}
+    if params.Container != 0 {
+        filter = " and container_id = ?"
+        args = append(args, params.Container)
+    }
+
     if params.Category == 0 {
         if params.Global == 1 {
-            rows, err = v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color from stores where user_id = ? and category_id = 0", usr.Id)
+            rows, err = v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color, version from stores where " + sqlStoreReadable + " and deleted_at is null and category_id = 0" + filter, args...)
         } else if params.Global == 2 {
-            rows, err = v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color from stores where user_id = ? order by last_used limit 16", usr.Id)
+            rows, err = v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color, version from stores where " + sqlStoreReadable + " and deleted_at is null" + filter + " order by last_used limit 16", args...)
         }
     } else {
-        rows, err = v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color from stores where user_id = ? and category_id = ?", usr.Id, params.Category)
+        rows, err = v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color, version from stores where " + sqlStoreReadable + " and deleted_at is null" + filter + " and category_id = ?", append(args, params.Category)...)
     }
 
     if err != nil || rows == nil {
-        log.Println("unable to fetch stores:", err)
-        return nil
+        slog.ErrorContext(ctx, "unable to fetch stores", "err", err)
+        return nil, err
     }
 
     var stores []Store
@@ -73,28 +98,27 @@ func (v *VincaDatabase) FetchStoresWith(usr *User, params *CategoryRequest) []St
         var st = Store{}
         err = rows.Scan(&st.Id, &st.Container, &st.Category,
                         &st.Created, &st.LastUsed, &st.Modified,
-                        &st.Name, &st.Description, &st.Icon, &st.Color)
+                        &st.Name, &st.Description, &st.Icon, &st.Color, &st.Version)
         if err != nil {
-            log.Println("unable to scan single store:", err)
+            slog.ErrorContext(ctx, "unable to scan single store", "err", err)
             continue
         }
 
         stores = append(stores, st)
     }
 
-    log.Println("fetch stories for", usr.Username)
-    return stores
+    return stores, nil
 }
 
-func (v *VincaDatabase) FetchStoreHistory(usr *User) []Store {
+func (v *VincaDatabase) FetchStoreHistory(ctx context.Context, usr *User) ([]Store, error) {
     if !usr.LastUsed {
-        return []Store{ }
+        return []Store{ }, nil
     }
 
-    rows, err := v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color from stores where user_id = ? order by last_used desc limit 8", usr.Id)
+    rows, err := v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color, version from stores where " + sqlStoreReadable + " and deleted_at is null order by last_used desc limit 8", usr.Id, usr.Id)
     if err != nil {
-        log.Println("unable to fetch stores:", err)
-        return nil
+        slog.ErrorContext(ctx, "unable to fetch stores", "err", err)
+        return nil, err
     }
 
     var stores []Store
@@ -102,23 +126,29 @@ func (v *VincaDatabase) FetchStoreHistory(usr *User) []Store {
         var st = Store{}
         err = rows.Scan(&st.Id, &st.Container, &st.Category,
                         &st.Created, &st.LastUsed, &st.Modified,
-                        &st.Name, &st.Description, &st.Icon, &st.Color)
+                        &st.Name, &st.Description, &st.Icon, &st.Color, &st.Version)
         if err != nil {
-            log.Println("unable to scan single store:", err)
+            slog.ErrorContext(ctx, "unable to scan single store", "err", err)
             continue
         }
         stores = append(stores, st)
     }
-    return stores
+    return stores, nil
 }
 
-func (v *VincaDatabase) FetchStoreQuery(usr *User, sq StoreQuery) []Store {
+func (v *VincaDatabase) FetchStoreQuery(ctx context.Context, usr *User, sq StoreQuery) ([]Store, error) {
     sq.Query = "%" + sq.Query + "%"
-    rows, err := v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color from stores where user_id = ? and (name like ? or description like ?) order by name asc limit 8",
-             usr.Id, sq.Query, sq.Query)
+    var query = "select id, container_id, category_id, created, last_used, modified, name, description, icon, color, version from stores where " + sqlStoreReadable + " and deleted_at is null and (name like ? or description like ?)"
+    var args = []interface{}{usr.Id, usr.Id, sq.Query, sq.Query}
+    if sq.Container != 0 {
+        query += " and container_id = ?"
+        args = append(args, sq.Container)
+    }
+
+    rows, err := v.db.Query(query + " order by name asc limit 8", args...)
     if err != nil {
-        log.Println("unable to fetch stores:", err)
-        return nil
+        slog.ErrorContext(ctx, "unable to fetch stores", "err", err)
+        return nil, err
     }
 
     var stores []Store
@@ -126,97 +156,128 @@ func (v *VincaDatabase) FetchStoreQuery(usr *User, sq StoreQuery) []Store {
         var st = Store{}
         err = rows.Scan(&st.Id, &st.Container, &st.Category,
                         &st.Created, &st.LastUsed, &st.Modified,
-                        &st.Name, &st.Description, &st.Icon, &st.Color)
+                        &st.Name, &st.Description, &st.Icon, &st.Color, &st.Version)
         if err != nil {
-            log.Println("unable to scan single store:", err)
+            slog.ErrorContext(ctx, "unable to scan single store", "err", err)
             continue
         }
         stores = append(stores, st)
     }
-    return stores
+    return stores, nil
 }
 
-func (v *VincaDatabase) UpdateStoreUsage(usr *User, st *Store) {
-    _, err := v.db.Exec("update stores set last_used = current_timestamp where id = ? and user_id = ?",
-            st.Id, usr.Id)
+func (v *VincaDatabase) UpdateStoreUsage(ctx context.Context, usr *User, st *Store) {
+    _, err := v.db.Exec("update stores set last_used = current_timestamp where id = ? and deleted_at is null and " + sqlStoreReadable,
+            st.Id, usr.Id, usr.Id)
 
     if err != nil {
-        log.Println("error occurred while last_used update:", err)
+        slog.ErrorContext(ctx, "error occurred while last_used update", "err", err)
     }
 }
 
-func (v *VincaDatabase) FetchStoreContent(usr *User, st *Store) error {
-    row := v.db.QueryRow("select category_id, created, last_used, modified, name, description, icon, color, content from stores where id = ? and user_id = ?", st.Id, usr.Id)
-    if err := row.Scan(&st.Category, &st.Created, &st.LastUsed,
+func (v *VincaDatabase) FetchStoreContent(ctx context.Context, usr *User, st *Store) error {
+    row := v.db.QueryRow("select container_id, category_id, created, last_used, modified, name, description, icon, color, version, content from stores where id = ? and deleted_at is null and " + sqlStoreReadable, st.Id, usr.Id, usr.Id)
+    if err := row.Scan(&st.Container, &st.Category, &st.Created, &st.LastUsed,
         &st.Modified, &st.Name, &st.Description,
-        &st.Icon, &st.Color, &st.Content); err != nil {
+        &st.Icon, &st.Color, &st.Version, &st.Content); err != nil {
 
-        log.Println("unable to fetch store content:", err)
+        slog.ErrorContext(ctx, "unable to fetch store content", "err", err)
         return err
     }
 
     if usr.LastUsed {
-        go v.UpdateStoreUsage(usr, st)
+        go v.UpdateStoreUsage(ctx, usr, st)
     }
 
-    log.Println("fetch store content for", usr.Username)
     return nil
 }
 
-func (v *VincaDatabase) SaveStore(usr *User, st *Store) error {
-    res, err := v.db.Exec("insert into stores(user_id, container_id, category_id, name, description, icon, color, content) values(?,?,?,?,?,?,?,?)",
-            usr.Id, st.Container, st.Category, st.Name, st.Description, st.Icon, st.Color, st.Content)
+// New stores are always owned by the container owner, also when created
+// by a member of a shared container.
+func (v *VincaDatabase) SaveStore(ctx context.Context, usr *User, st *Store) error {
+    res, err := v.db.Exec("insert into stores(user_id, container_id, category_id, name, description, icon, color, content, version) values((select user_id from containers where id = ?),?,?,?,?,?,?,?,1)",
+            st.Container, st.Container, st.Category, st.Name, st.Description, st.Icon, st.Color, st.Content)
 
     if err != nil {
-        log.Println("unable to insert store:", err)
+        slog.ErrorContext(ctx, "unable to insert store", "err", err)
         return err
     }
 
     sid, err := res.LastInsertId()
     if err != nil {
-        log.Println("unable to fetch last insert id:", err)
+        slog.ErrorContext(ctx, "unable to fetch last insert id", "err", err)
         return err
     }
 
     st.Id = int(sid)
+    st.Version = 1
     return nil
 }
 
-func (v *VincaDatabase) UpdateStore(usr *User, st *Store) error {
-    res, err := v.db.Exec("update stores set category_id = ?, name = ?, description = ?, icon = ?, color = ?, content = ? where id = ? and user_id = ?",
-            st.Category, st.Name, st.Description, st.Icon, st.Color, st.Content, st.Id, usr.Id)
+// The previous state of the store is kept as a revision before the update,
+// which only succeeds when st.Version still matches the stored version.
+func (v *VincaDatabase) UpdateStore(ctx context.Context, usr *User, st *Store) error {
+    tx, err := v.db.Begin()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to begin store update", "err", err)
+        return err
+    }
+    defer tx.Rollback()
 
+    _, err = tx.Exec("insert into store_revisions(store_id, name, description, icon, color, content) select id, name, description, icon, color, content from stores where id = ? and deleted_at is null and " + sqlStoreWritable,
+            st.Id, usr.Id, usr.Id)
     if err != nil {
-        log.Println("unable to update store:", err)
+        slog.ErrorContext(ctx, "unable to save store revision", "err", err)
+        return err
+    }
+
+    res, err := tx.Exec("update stores set category_id = ?, name = ?, description = ?, icon = ?, color = ?, content = ?, version = version + 1, modified = current_timestamp where id = ? and version = ? and deleted_at is null and " + sqlStoreWritable,
+            st.Category, st.Name, st.Description, st.Icon, st.Color, st.Content, st.Id, st.Version, usr.Id, usr.Id)
+
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to update store", "err", err)
         return err
     }
 
     rows, err := res.RowsAffected()
     if err != nil {
-        log.Println("unable to fetch rows updated:", err)
+        slog.ErrorContext(ctx, "unable to fetch rows updated", "err", err)
         return err
     }
 
     if rows != 1 {
-        log.Println("invalid rows updated!! Count:", rows)
+        slog.InfoContext(ctx, "stale store update rejected", "store", st.Id, "version", st.Version)
+        return ErrStaleWrite
+    }
+
+    if err = PruneStoreRevisions(ctx, tx, st.Id, vincaConfig.RevisionLimit()); err != nil {
+        return err
+    }
+
+    if err = tx.Commit(); err != nil {
+        slog.ErrorContext(ctx, "unable to commit store update", "err", err)
+        return err
     }
+    st.Version++
     return nil
 }
 
-func (v *VincaDatabase) DestroyStore(usr *User, st *Store) error {
-    res, err := v.db.Exec("delete from stores where id = ? and user_id = ? limit 1", st.Id, usr.Id)
+// Moves the store into the trash, see PurgeStore for the actual removal.
+func (v *VincaDatabase) DestroyStore(ctx context.Context, usr *User, st *Store) error {
+    res, err := v.db.Exec("update stores set deleted_at = current_timestamp, modified = current_timestamp where id = ? and deleted_at is null and " + sqlStoreWritable,
+            st.Id, usr.Id, usr.Id)
     if err != nil {
-        log.Println("unable to remove store:", err)
+        slog.ErrorContext(ctx, "unable to move store to trash", "err", err)
         return err
     }
 
     rows, err := res.RowsAffected()
     if err != nil {
-        log.Println("unable to fetch rows affected:", err)
+        slog.ErrorContext(ctx, "unable to fetch rows affected", "err", err)
         return err
     }
     if rows != 1 {
-        log.Println("invalid number of deleted rows reported:", rows)
+        slog.WarnContext(ctx, "invalid number of trashed rows reported", "affected", rows)
     }
     return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,204 @@
+package main
+
+import "context"
+import "log/slog"
+import "time"
+import "strconv"
+
+const TombstoneStore = "store"
+const TombstoneCategory = "category"
+const TombstoneContainer = "container"
+
+// Containers the user joined or whose membership changed since the cursor,
+// their stores and categories are sent in full regardless of their age.
+const sqlSyncJoined = "select container_id from container_members where user_id = ? and modified >= ?"
+
+// Same as sqlCategoryShared, limited to containers joined since the cursor.
+const sqlCategoryJoined = "id in (select s.category_id from stores s join containers c on c.id = s.container_id join container_members m on m.container_id = c.id where m.user_id = ? and m.modified >= ? and s.deleted_at is null and c.user_id = categories.user_id)"
+
+func init() {
+    vincaMux.NewRoute("/api/v1/sync").Middleware(auth_middleware).HandleAuth(api_sync, "GET")
+}
+
+type Tombstone struct {
+    Kind string `json:"kind"`
+    Id int `json:"id"`
+    Deleted Datetime `json:"deleted"`
+}
+
+// Everything changed since the requested cursor. Full is set when the
+// cursor was missing or too old, the client should then replace its
+// local state instead of merging it.
+type SyncResponse struct {
+    Cursor string `json:"cursor"`
+    Full bool `json:"full"`
+    Containers []Container `json:"containers"`
+    Categories []*Category `json:"categories"`
+    Stores []Store `json:"stores"`
+    Deleted []Tombstone `json:"deleted"`
+}
+
+func (v *VincaDatabase) SaveTombstone(ctx context.Context, userid, container int, kind string, id int) {
+    _, err := v.db.Exec("insert into tombstones(user_id, container_id, kind, object_id, deleted) values(?,?,?,?,current_timestamp)",
+            userid, container, kind, id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to save tombstone", "err", err)
+    }
+}
+
+func (v *VincaDatabase) FetchTombstones(ctx context.Context, usr *User, since string) ([]Tombstone, error) {
+    rows, err := v.db.Query("select kind, object_id, deleted from tombstones where deleted >= ? and (user_id = ? or (kind = ? and container_id in (select container_id from container_members where user_id = ?)))",
+            since, usr.Id, TombstoneStore, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch tombstones", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var tombstones = []Tombstone{}
+    for rows.Next() {
+        var ts = Tombstone{}
+        if err = rows.Scan(&ts.Kind, &ts.Id, &ts.Deleted); err != nil {
+            slog.ErrorContext(ctx, "unable to scan tombstone", "err", err)
+            continue
+        }
+        tombstones = append(tombstones, ts)
+    }
+
+    // Trashed stores are gone for the client until they get restored.
+    rows, err = v.db.Query("select id, deleted_at from stores where deleted_at is not null and modified >= ? and " + sqlStoreReadable,
+            since, usr.Id, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch trashed stores", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var ts = Tombstone{Kind: TombstoneStore}
+        if err = rows.Scan(&ts.Id, &ts.Deleted); err != nil {
+            slog.ErrorContext(ctx, "unable to scan trashed store", "err", err)
+            continue
+        }
+        tombstones = append(tombstones, ts)
+    }
+    return tombstones, nil
+}
+
+func (v *VincaDatabase) FetchSyncContainers(ctx context.Context, usr *User, since string) ([]Container, error) {
+    rows, err := v.db.Query("select id, name, public, encrypted, false, '' from containers where user_id = ? and modified >= ? union all select c.id, c.name, c.public, m.encrypted, true, m.role from containers c join container_members m on m.container_id = c.id where m.user_id = ? and (c.modified >= ? or m.modified >= ?)",
+            usr.Id, since, usr.Id, since, since)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch changed containers", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var containers = []Container{}
+    for rows.Next() {
+        var container = Container{}
+        if err = rows.Scan(&container.Id, &container.Name, &container.Certificate, &container.Encrypted, &container.Shared, &container.Role); err != nil {
+            slog.ErrorContext(ctx, "unable to scan changed container", "err", err)
+            continue
+        }
+        containers = append(containers, container)
+    }
+    return containers, nil
+}
+
+func (v *VincaDatabase) FetchSyncCategories(ctx context.Context, usr *User, since string) ([]*Category, error) {
+    rows, err := v.db.Query("select id, name, description, icon, version from categories where (modified >= ? and (user_id = ? or " + sqlCategoryShared + ")) or " + sqlCategoryJoined,
+            since, usr.Id, usr.Id, usr.Id, since)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch changed categories", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var categories = []*Category{}
+    for rows.Next() {
+        var category = &Category{}
+        if err = rows.Scan(&category.Id, &category.Name, &category.Description, &category.Icon, &category.Version); err != nil {
+            slog.ErrorContext(ctx, "unable to scan changed category", "err", err)
+            continue
+        }
+        categories = append(categories, category)
+    }
+    return categories, nil
+}
+
+func (v *VincaDatabase) FetchSyncStores(ctx context.Context, usr *User, since string) ([]Store, error) {
+    rows, err := v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color, version, content from stores where deleted_at is null and (modified >= ? or container_id in (" + sqlSyncJoined + ")) and " + sqlStoreReadable,
+            since, usr.Id, since, usr.Id, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch changed stores", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var stores = []Store{}
+    for rows.Next() {
+        var st = Store{}
+        err = rows.Scan(&st.Id, &st.Container, &st.Category,
+                        &st.Created, &st.LastUsed, &st.Modified,
+                        &st.Name, &st.Description, &st.Icon, &st.Color, &st.Version, &st.Content)
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to scan changed store", "err", err)
+            continue
+        }
+        stores = append(stores, st)
+    }
+    return stores, nil
+}
+
+// Cursors are unix timestamps of the database clock. Changes are fetched
+// inclusive of the cursor second, clients apply them idempotently.
+func api_sync(r *Request, usr *User) interface{} {
+    now, err := vincaRepository.Now(r.Context())
+    if err != nil {
+        return err
+    }
+
+    var since = time.Unix(0, 0).UTC()
+    var full = true
+    if cursor := r.URL.Query().Get("since"); cursor != "" {
+        unix, err := strconv.ParseInt(cursor, 10, 64)
+        if err != nil {
+            return ErrInvalidParams
+        }
+
+        since = time.Unix(unix, 0).UTC()
+        full = since.Before(time.Time(now).Add(-vincaConfig.TrashLifetime()))
+        if full {
+            since = time.Unix(0, 0).UTC()
+        }
+    }
+    sinceStr := since.Format("2006-01-02 15:04:05")
+
+    // A partial change set would advance the client cursor past the
+    // missing changes, so any failure fails the whole sync.
+    var resp = SyncResponse{
+        Cursor: strconv.FormatInt(time.Time(now).Unix(), 10),
+        Full: full,
+        Deleted: []Tombstone{},
+    }
+
+    if resp.Containers, err = vincaRepository.FetchSyncContainers(r.Context(), usr, sinceStr); err != nil {
+        return err
+    }
+
+    if resp.Categories, err = vincaRepository.FetchSyncCategories(r.Context(), usr, sinceStr); err != nil {
+        return err
+    }
+
+    if resp.Stores, err = vincaRepository.FetchSyncStores(r.Context(), usr, sinceStr); err != nil {
+        return err
+    }
+
+    if !full {
+        if resp.Deleted, err = vincaRepository.FetchTombstones(r.Context(), usr, sinceStr); err != nil {
+            return err
+        }
+    }
+    return resp
+}
@@ -0,0 +1,255 @@
+package main
+
+import "context"
+import "log/slog"
+import "fmt"
+import "sync"
+import "time"
+import "strings"
+import "net/url"
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha1"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/base32"
+import "encoding/binary"
+
+const TotpPeriod = 30
+const TotpDigits = 6
+const TotpIssuer = "Vinca"
+const RecoveryCodeCount = 10
+
+const PendingLoginLifetime = 5 * time.Minute
+const PendingLoginAttempts = 5
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type PendingLogin struct {
+    userid int
+    expires time.Time
+    attempts int
+}
+
+type PendingLogins struct {
+    mu sync.Mutex
+    logins map[string]*PendingLogin
+}
+
+var vincaPendingLogins = PendingLogins{logins: make(map[string]*PendingLogin)}
+
+func NewTotpSecret() ([]byte, error) {
+    var secret = make([]byte, 20)
+    if _, err := rand.Read(secret); err != nil {
+        return nil, err
+    }
+    return secret, nil
+}
+
+func TotpURI(usr *User, secret []byte) string {
+    var params = url.Values{}
+    params.Set("secret", totpEncoding.EncodeToString(secret))
+    params.Set("issuer", TotpIssuer)
+    params.Set("algorithm", "SHA1")
+    params.Set("digits", fmt.Sprint(TotpDigits))
+    params.Set("period", fmt.Sprint(TotpPeriod))
+
+    label := url.PathEscape(TotpIssuer + ":" + usr.Email)
+    return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// RFC 6238 code for the given time step, HOTP truncation from RFC 4226.
+func TotpCode(secret []byte, step uint64) string {
+    var msg [8]byte
+    binary.BigEndian.PutUint64(msg[:], step)
+
+    mac := hmac.New(sha1.New, secret)
+    mac.Write(msg[:])
+    sum := mac.Sum(nil)
+
+    offset := sum[len(sum) - 1] & 0x0f
+    code := binary.BigEndian.Uint32(sum[offset:offset + 4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", TotpDigits, code % 1000000)
+}
+
+// Returns the time step of the code, codes from the previous and next
+// time step are accepted to allow for clock drift.
+func TotpMatch(secret []byte, code string, now time.Time) (uint64, bool) {
+    if len(secret) == 0 || len(code) != TotpDigits {
+        return 0, false
+    }
+
+    step := uint64(now.Unix() / TotpPeriod)
+    for _, s := range []uint64{step - 1, step, step + 1} {
+        if hmac.Equal([]byte(TotpCode(secret, s)), []byte(code)) {
+            return s, true
+        }
+    }
+    return 0, false
+}
+
+func NewRecoveryCodes() ([]string, error) {
+    var codes []string
+    for i := 0; i < RecoveryCodeCount; i++ {
+        var buf = make([]byte, 5)
+        if _, err := rand.Read(buf); err != nil {
+            return nil, err
+        }
+        code := hex.EncodeToString(buf)
+        codes = append(codes, code[:5] + "-" + code[5:])
+    }
+    return codes, nil
+}
+
+func HashRecoveryCode(code string) []byte {
+    code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+    sum := sha256.Sum256([]byte(code))
+    return sum[:]
+}
+
+func (pl *PendingLogins) Create(ctx context.Context, usr *User) string {
+    var buf = make([]byte, 24)
+    if _, err := rand.Read(buf); err != nil {
+        slog.ErrorContext(ctx, "unable to create pending login token", "err", err)
+        return ""
+    }
+    token := hex.EncodeToString(buf)
+    now := time.Now()
+
+    pl.mu.Lock()
+    defer pl.mu.Unlock()
+
+    for t, p := range pl.logins {
+        if now.After(p.expires) {
+            delete(pl.logins, t)
+        }
+    }
+    pl.logins[token] = &PendingLogin{userid: usr.Id, expires: now.Add(PendingLoginLifetime)}
+
+    return token
+}
+
+// Returns the user id waiting for the second factor, every lookup counts
+// as an attempt and the token is dropped once the limit is reached.
+func (pl *PendingLogins) Attempt(token string) (int, bool) {
+    pl.mu.Lock()
+    defer pl.mu.Unlock()
+
+    pending, ok := pl.logins[token]
+    if !ok {
+        return 0, false
+    }
+
+    pending.attempts++
+    if time.Now().After(pending.expires) || pending.attempts > PendingLoginAttempts {
+        delete(pl.logins, token)
+        return 0, false
+    }
+    return pending.userid, true
+}
+
+func (pl *PendingLogins) Remove(token string) {
+    pl.mu.Lock()
+    delete(pl.logins, token)
+    pl.mu.Unlock()
+}
+
+func (v *VincaDatabase) SaveTotpSecret(ctx context.Context, usr *User, secret []byte) error {
+    _, err := v.db.Exec("update users set totp_secret = ?, totp_enabled = 0, totp_step = 0 where id = ?", secret, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to save totp secret", "err", err)
+        return err
+    }
+    usr.totpSecret = secret
+    usr.TwoFactor = false
+    return nil
+}
+
+func (v *VincaDatabase) EnableTotp(ctx context.Context, usr *User, codes []string) error {
+    tx, err := v.db.Begin()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to begin totp transaction", "err", err)
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err = tx.Exec("update users set totp_enabled = 1 where id = ?", usr.Id); err != nil {
+        slog.ErrorContext(ctx, "unable to enable totp", "err", err)
+        return err
+    }
+
+    if _, err = tx.Exec("delete from recovery_codes where user_id = ?", usr.Id); err != nil {
+        slog.ErrorContext(ctx, "unable to remove old recovery codes", "err", err)
+        return err
+    }
+
+    for _, code := range codes {
+        if _, err = tx.Exec("insert into recovery_codes(user_id, code) values(?,?)", usr.Id, HashRecoveryCode(code)); err != nil {
+            slog.ErrorContext(ctx, "unable to save recovery code", "err", err)
+            return err
+        }
+    }
+
+    if err = tx.Commit(); err != nil {
+        slog.ErrorContext(ctx, "unable to commit totp enable", "err", err)
+        return err
+    }
+    usr.TwoFactor = true
+    return nil
+}
+
+func (v *VincaDatabase) DisableTotp(ctx context.Context, usr *User) error {
+    if _, err := v.db.Exec("update users set totp_secret = null, totp_enabled = 0, totp_step = 0 where id = ?", usr.Id); err != nil {
+        slog.ErrorContext(ctx, "unable to disable totp", "err", err)
+        return err
+    }
+
+    if _, err := v.db.Exec("delete from recovery_codes where user_id = ?", usr.Id); err != nil {
+        slog.ErrorContext(ctx, "unable to remove recovery codes", "err", err)
+        return err
+    }
+    usr.totpSecret = nil
+    usr.TwoFactor = false
+    return nil
+}
+
+func (v *VincaDatabase) ConsumeRecoveryCode(ctx context.Context, usr *User, code string) bool {
+    res, err := v.db.Exec("delete from recovery_codes where user_id = ? and code = ?", usr.Id, HashRecoveryCode(code))
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to consume recovery code", "err", err)
+        return false
+    }
+
+    rows, err := res.RowsAffected()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch consumed recovery codes", "err", err)
+        return false
+    }
+    return rows == 1
+}
+
+// Remembers the time step of an accepted code, a code is only accepted
+// for steps after the last one so it cannot be replayed within its window.
+func (v *VincaDatabase) ConsumeTotpStep(ctx context.Context, usr *User, step uint64) bool {
+    res, err := v.db.Exec("update users set totp_step = ? where id = ? and totp_step < ?", step, usr.Id, step)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to save totp step", "err", err)
+        return false
+    }
+
+    rows, err := res.RowsAffected()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch saved totp step", "err", err)
+        return false
+    }
+    return rows == 1
+}
+
+// Checks either a current, not yet used TOTP code or one of the unused
+// recovery codes.
+func (v *VincaDatabase) VerifySecondFactor(ctx context.Context, usr *User, code string) bool {
+    if step, ok := TotpMatch(usr.totpSecret, code, time.Now()); ok {
+        return v.ConsumeTotpStep(ctx, usr, step)
+    }
+    return len(code) > TotpDigits && v.ConsumeRecoveryCode(ctx, usr, code)
+}
@@ -0,0 +1,41 @@
+package main
+
+import "time"
+import "testing"
+
+// SHA1 test vectors of RFC 6238 appendix B, the codes are the low six
+// digits of the eight digit values listed there.
+func TestTotpCodeRFC6238(t *testing.T) {
+    var secret = []byte("12345678901234567890")
+    for _, tt := range []struct{ unix int64; code string }{
+        {59, "287082"},
+        {1111111109, "081804"},
+        {1111111111, "050471"},
+        {1234567890, "005924"},
+        {2000000000, "279037"},
+        {20000000000, "353130"},
+    } {
+        if code := TotpCode(secret, uint64(tt.unix / TotpPeriod)); code != tt.code {
+            t.Errorf("time %d: expected %s, got %s", tt.unix, tt.code, code)
+        }
+    }
+}
+
+func TestTotpMatch(t *testing.T) {
+    var secret = []byte("12345678901234567890")
+    var now = time.Unix(1111111111, 0)
+    step := uint64(now.Unix() / TotpPeriod)
+
+    for _, tt := range []struct{ step uint64; ok bool }{
+        {step - 2, false},
+        {step - 1, true},
+        {step, true},
+        {step + 1, true},
+        {step + 2, false},
+    } {
+        matched, ok := TotpMatch(secret, TotpCode(secret, tt.step), now)
+        if ok != tt.ok || (ok && matched != tt.step) {
+            t.Errorf("step %d: got %d %v", tt.step, matched, ok)
+        }
+    }
+}
@@ -0,0 +1,188 @@
+package main
+
+import "context"
+import "log/slog"
+import "time"
+import "net/http"
+
+var ErrNotInTrash = NewHandlerErr("store_not_trashed", http.StatusNotFound)
+
+// Trashed stores keep their content, so they can be re-encrypted during
+// a container key rotation and restored afterwards.
+type TrashedStore struct {
+    Store
+    Deleted Datetime `json:"deleted_at"`
+}
+
+func StartTrashPurge(retention time.Duration) {
+    go func() {
+        ticker := time.NewTicker(time.Hour)
+        defer ticker.Stop()
+
+        for ; true; <-ticker.C {
+            vincaRepository.PurgeExpiredTrash(context.Background(), retention)
+        }
+    }()
+}
+
+func (v *VincaDatabase) FetchTrash(ctx context.Context, usr *User) ([]TrashedStore, error) {
+    rows, err := v.db.Query("select id, container_id, category_id, created, last_used, modified, deleted_at, name, description, icon, color, version, content from stores where deleted_at is not null and " + sqlStoreReadable + " order by deleted_at desc",
+            usr.Id, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch trash", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var stores = []TrashedStore{}
+    for rows.Next() {
+        var st = TrashedStore{}
+        err = rows.Scan(&st.Id, &st.Container, &st.Category,
+                        &st.Created, &st.LastUsed, &st.Modified, &st.Deleted,
+                        &st.Name, &st.Description, &st.Icon, &st.Color, &st.Version, &st.Content)
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to scan trashed store", "err", err)
+            continue
+        }
+        stores = append(stores, st)
+    }
+    return stores, nil
+}
+
+func (v *VincaDatabase) RestoreStore(ctx context.Context, usr *User, st *Store) error {
+    res, err := v.db.Exec("update stores set deleted_at = null, modified = current_timestamp where id = ? and deleted_at is not null and " + sqlStoreWritable,
+            st.Id, usr.Id, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to restore store", "err", err)
+        return err
+    }
+
+    rows, err := res.RowsAffected()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch restored rows", "err", err)
+        return err
+    }
+
+    if rows != 1 {
+        return ErrNotInTrash
+    }
+    return nil
+}
+
+func (v *VincaDatabase) PurgeStore(ctx context.Context, usr *User, st *Store) error {
+    tx, err := v.db.Begin()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to begin store purge", "err", err)
+        return err
+    }
+    defer tx.Rollback()
+
+    _, err = tx.Exec("insert into tombstones(user_id, container_id, kind, object_id, deleted) select user_id, container_id, ?, id, current_timestamp from stores where id = ? and deleted_at is not null and " + sqlStoreWritable,
+            TombstoneStore, st.Id, usr.Id, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to save store tombstone", "err", err)
+        return err
+    }
+
+    res, err := tx.Exec("delete from stores where id = ? and deleted_at is not null and " + sqlStoreWritable,
+            st.Id, usr.Id, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to purge store", "err", err)
+        return err
+    }
+
+    if rows, err := res.RowsAffected(); err != nil || rows != 1 {
+        return ErrNotInTrash
+    }
+
+    if _, err = tx.Exec("delete from store_revisions where store_id = ?", st.Id); err != nil {
+        slog.ErrorContext(ctx, "unable to purge store revisions", "err", err)
+        return err
+    }
+
+    if err = tx.Commit(); err != nil {
+        slog.ErrorContext(ctx, "unable to commit store purge", "err", err)
+        return err
+    }
+    return nil
+}
+
+// Empties the trash of the containers owned by the user, the trash of
+// shared containers stays with their owner and is only purged store by
+// store.
+func (v *VincaDatabase) EmptyTrash(ctx context.Context, usr *User) (int, error) {
+    rows, err := v.db.Query("select id from stores where deleted_at is not null and user_id = ?", usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to fetch owned trash", "err", err)
+        return 0, err
+    }
+
+    var trash []int
+    for rows.Next() {
+        var id int
+        if err = rows.Scan(&id); err != nil {
+            slog.ErrorContext(ctx, "unable to scan trashed store", "err", err)
+            continue
+        }
+        trash = append(trash, id)
+    }
+    rows.Close()
+
+    var purged int
+    for _, id := range trash {
+        if err := v.PurgeStore(ctx, usr, &Store{Id: id}); err == nil {
+            purged++
+        }
+    }
+    return purged, nil
+}
+
+func (v *VincaDatabase) PurgeExpiredTrash(ctx context.Context, retention time.Duration) {
+    // deleted_at is set from current_timestamp, the cutoff has to come
+    // from the same clock and in the same format.
+    now, err := v.Now(ctx)
+    if err != nil {
+        return
+    }
+    before := time.Time(now).UTC().Add(-retention).Format("2006-01-02 15:04:05")
+
+    tx, err := v.db.Begin()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to begin trash purge", "err", err)
+        return
+    }
+    defer tx.Rollback()
+
+    if _, err = tx.Exec("delete from store_revisions where store_id in (select id from stores where deleted_at < ?)", before); err != nil {
+        slog.ErrorContext(ctx, "unable to purge expired store revisions", "err", err)
+        return
+    }
+
+    _, err = tx.Exec("insert into tombstones(user_id, container_id, kind, object_id, deleted) select user_id, container_id, ?, id, current_timestamp from stores where deleted_at < ?",
+            TombstoneStore, before)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to save expired store tombstones", "err", err)
+        return
+    }
+
+    res, err := tx.Exec("delete from stores where deleted_at < ?", before)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to purge expired trash", "err", err)
+        return
+    }
+
+    // Clients with a cursor older than the retention get a full sync instead.
+    if _, err = tx.Exec("delete from tombstones where deleted < ?", before); err != nil {
+        slog.ErrorContext(ctx, "unable to purge expired tombstones", "err", err)
+        return
+    }
+
+    if err = tx.Commit(); err != nil {
+        slog.ErrorContext(ctx, "unable to commit trash purge", "err", err)
+        return
+    }
+
+    if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+        slog.InfoContext(ctx, "purged expired stores from trash", "count", rows)
+    }
+}
@@ -1,7 +1,9 @@
 package main
 
-import "log"
+import "context"
+import "log/slog"
 import "database/sql"
+import "errors"
 import "regexp"
 import "golang.org/x/crypto/bcrypt"
 
@@ -17,42 +19,43 @@ type User struct {
     UserParam
     Id int `json:"-"`
     Avatar string `json:"avatar"`
+    TwoFactor bool `json:"two_factor"`
     hash []byte
+    totpSecret []byte
 }
 
 var RgxUsernameCheck = regexp.MustCompile("^[A-Za-z]{1,16}$")
 var RgxEmailCheck = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
-func (p *UserParam) Valid() bool {
-    if !RgxEmailCheck.MatchString(p.Email) || !RgxUsernameCheck.MatchString(p.Username)  {
+// Wrong passwords are expected and only logged at debug level, the
+// handlers report failed logins themselves.
+func (usr *User) Authenticate(ctx context.Context, password string) bool {
+    err := bcrypt.CompareHashAndPassword(usr.hash, []byte(password))
+    if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+        slog.DebugContext(ctx, "password mismatch", "user", usr)
         return false
     }
-    return true
-}
-
-func (usr *User) Authenticate(password string) bool {
-    err := bcrypt.CompareHashAndPassword(usr.hash, []byte(password))
     if err != nil {
-        log.Println("auth err:", err)
+        slog.ErrorContext(ctx, "auth err", "err", err)
         return false
     }
     return true
 }
 
-func (usr *User) SetPassword(password string) error {
+func (usr *User) SetPassword(ctx context.Context, password string) error {
     var err error
 
     usr.hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
     if err != nil {
-        log.Println("user save bcrypt err:", err)
+        slog.ErrorContext(ctx, "user save bcrypt err", "err", err)
         return err
     }
     return nil
 }
 
-func (v *VincaDatabase) UserSave(usr *User) error {
+func (v *VincaDatabase) UserSave(ctx context.Context, usr *User) error {
     var uid int64
-    if err := usr.SetPassword(usr.Password); err != nil {
+    if err := usr.SetPassword(ctx, usr.Password); err != nil {
         return err
     }
 
@@ -60,58 +63,62 @@ func (v *VincaDatabase) UserSave(usr *User) error {
         if err == nil {
             return ErrUsedEmail
         }
-        log.Println("error while email check:", err)
+        slog.ErrorContext(ctx, "error while email check", "err", err)
         return err
     }
 
     res, err := v.db.Exec("insert into users(username, email, password) values(?,?,?)",
             usr.Username, usr.Email, usr.hash)
     if err != nil {
-        log.Println("user save db err:", err)
+        slog.ErrorContext(ctx, "user save db err", "err", err)
         return err
     }
 
     uid, err = res.LastInsertId()
     if err != nil {
-        log.Println("user save id fetch err:", err)
+        slog.ErrorContext(ctx, "user save id fetch err", "err", err)
     } else {
         usr.Id = int(uid)
     }
     return nil
 }
 
-func (v *VincaDatabase) FetchUser(email string) *User {
+func (v *VincaDatabase) FetchUser(ctx context.Context, email string) *User {
     var usr = &User{}
-    err := v.db.QueryRow("select id, username, email, password, avatar, show_last_used, dark_mode from users where email = ?", email).Scan(
-        &usr.Id, &usr.Username, &usr.Email, &usr.hash, &usr.Avatar, &usr.LastUsed, &usr.DarkMode,
+    err := v.db.QueryRow("select id, username, email, password, avatar, show_last_used, dark_mode, totp_secret, totp_enabled from users where email = ?", email).Scan(
+        &usr.Id, &usr.Username, &usr.Email, &usr.hash, &usr.Avatar, &usr.LastUsed, &usr.DarkMode, &usr.totpSecret, &usr.TwoFactor,
     )
 
     if err != nil {
-        log.Println("unable to fetch user:", err)
+        slog.ErrorContext(ctx, "unable to fetch user", "err", err)
         return nil
     }
     return usr
 }
 
-func (v *VincaDatabase) FetchUserFromSession(session *VincaSession) *User {
+func (v *VincaDatabase) FetchUserFromSession(ctx context.Context, session *VincaSession) *User {
+    return v.FetchUserById(ctx, session.userid)
+}
+
+func (v *VincaDatabase) FetchUserById(ctx context.Context, uid int) *User {
     var usr = &User{}
-    err := v.db.QueryRow("select id, username, email, password, avatar, show_last_used, dark_mode from users where id = ?", session.userid).Scan(
-        &usr.Id, &usr.Username, &usr.Email, &usr.hash, &usr.Avatar, &usr.LastUsed, &usr.DarkMode,
+    err := v.db.QueryRow("select id, username, email, password, avatar, show_last_used, dark_mode, totp_secret, totp_enabled from users where id = ?", uid).Scan(
+        &usr.Id, &usr.Username, &usr.Email, &usr.hash, &usr.Avatar, &usr.LastUsed, &usr.DarkMode, &usr.totpSecret, &usr.TwoFactor,
     )
     if err != nil {
-        log.Println("no user for session:", err)
+        slog.ErrorContext(ctx, "no user for id", "err", err)
         return nil
     }
     return usr
 }
 
-func (v *VincaDatabase) UpdateUser(usr *User, params UserParam) error {
+func (v *VincaDatabase) UpdateUser(ctx context.Context, usr *User, params UserParam) error {
     if usr.Email != params.Email {
         var uid int
         err := v.db.QueryRow("select id from users where email = ?", params.Email).Scan(&uid)
 
         if err != nil && err != sql.ErrNoRows {
-            log.Println("error while email check:", err)
+            slog.ErrorContext(ctx, "error while email check", "err", err)
             return err
         } else if err == nil {
             return ErrUsedEmail
@@ -119,7 +126,7 @@ func (v *VincaDatabase) UpdateUser(usr *User, params UserParam) error {
     }
 
     if params.Password != "" {
-        if err := usr.SetPassword(params.Password); err != nil {
+        if err := usr.SetPassword(ctx, params.Password); err != nil {
             return err
         }
     }
@@ -127,7 +134,7 @@ func (v *VincaDatabase) UpdateUser(usr *User, params UserParam) error {
     _, err := v.db.Exec("update users set email = ?, password = ?, show_last_used = ?, dark_mode = ? where id = ?",
             params.Email, usr.hash, params.LastUsed, params.DarkMode, usr.Id)
     if err != nil {
-        log.Println("unable to update user properties:", err)
+        slog.ErrorContext(ctx, "unable to update user properties", "err", err)
         return err
     }
     usr.DarkMode = params.DarkMode
@@ -136,3 +143,12 @@ func (v *VincaDatabase) UpdateUser(usr *User, params UserParam) error {
 
     return nil
 }
+
+func (v *VincaDatabase) UpdatePassword(ctx context.Context, usr *User) error {
+    _, err := v.db.Exec("update users set password = ? where id = ?", usr.hash, usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to update user password", "err", err)
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import "fmt"
+import "strings"
+import "unicode/utf8"
+
+const MaxNameLength = 128
+const MaxDescriptionLength = 1024
+const MaxIconValue = 1024
+
+// Request parameters implementing Validator are checked by Request.Decode
+// right after decoding, failures are answered with per-field details.
+type Validator interface {
+    Validate() error
+}
+
+// Collects the rejected fields of a request, Err returns nil when every
+// check passed.
+type Validation struct {
+    fields []FieldError
+}
+
+func (v *Validation) Fail(field, code, message string) {
+    v.fields = append(v.fields, FieldError{Field: field, Code: code, Message: message})
+}
+
+func (v *Validation) Check(ok bool, field, code, message string) {
+    if !ok {
+        v.Fail(field, code, message)
+    }
+}
+
+func (v *Validation) Required(field, value string) {
+    v.Check(strings.TrimSpace(value) != "", field, "required", "must not be empty")
+}
+
+func (v *Validation) MaxLength(field, value string, max int) {
+    v.Check(utf8.RuneCountInString(value) <= max, field, "too_long",
+            fmt.Sprintf("must not be longer than %d characters", max))
+}
+
+func (v *Validation) MaxBytes(field string, value []byte, max int) {
+    v.Check(len(value) <= max, field, "too_large",
+            fmt.Sprintf("must not be larger than %d bytes", max))
+}
+
+func (v *Validation) Range(field string, value, min, max int) {
+    v.Check(value >= min && value <= max, field, "out_of_range",
+            fmt.Sprintf("must be between %d and %d", min, max))
+}
+
+// Applies the configured password policy, inputs are user data that
+// must not make up the password.
+func (v *Validation) Password(field, password string, inputs ...string) {
+    v.fields = append(v.fields, vincaPasswordPolicy.Check(field, password, inputs...)...)
+}
+
+// Name of a field inside a list element, such as stores[2].content.
+func ElementField(list string, index int, field string) string {
+    return fmt.Sprintf("%s[%d].%s", list, index, field)
+}
+
+func (v *Validation) Err() error {
+    if len(v.fields) == 0 {
+        return nil
+    }
+    return NewValidationErr(v.fields...)
+}
+
+func (p *StoreParam) Validate() error {
+    var v = Validation{}
+    v.Required("name", p.Name)
+    v.MaxLength("name", p.Name, MaxNameLength)
+    v.MaxLength("description", p.Description, MaxDescriptionLength)
+    v.MaxBytes("content", p.Content, vincaConfig.Limits.ContentLimit())
+    v.Range("icon", p.Icon, 0, MaxIconValue)
+    v.Check(p.Color >= 0, "color", "out_of_range", "must not be negative")
+    v.Check(p.Container >= 0, "container", "out_of_range", "must not be negative")
+    v.Check(p.Category >= 0, "category", "out_of_range", "must not be negative")
+    return v.Err()
+}
+
+func (ref *StoreReference) Validate() error {
+    var v = Validation{}
+    v.Check(ref.Id > 0, "id", "required", "must reference a store")
+    return v.Err()
+}
+
+func (p *CategoryParams) Validate() error {
+    var v = Validation{}
+    v.Required("name", p.Name)
+    v.MaxLength("name", p.Name, MaxNameLength)
+    v.MaxLength("description", p.Description, MaxDescriptionLength)
+    v.Range("icon", p.Icon, 0, MaxIconValue)
+    return v.Err()
+}
+
+func (req *CategoryDestroyRequest) Validate() error {
+    var v = Validation{}
+    v.Check(req.Id > 0, "id", "required", "must reference a category")
+    v.Check(req.Migrate >= 0, "migrate", "out_of_range", "must not be negative")
+    v.Check(req.Migrate != req.Id, "migrate", "invalid", "must differ from the removed category")
+    return v.Err()
+}
+
+func (req *ContainerRequest) Validate() error {
+    var v = Validation{}
+    v.MaxLength("name", req.Name, MaxNameLength)
+    v.Check(len(req.Certificate) > 0, "certificate", "required", "must not be empty")
+    v.Check(len(req.Encrypted) > 0, "encrypted", "required", "must not be empty")
+    v.MaxBytes("certificate", req.Certificate, vincaConfig.Limits.ContentLimit())
+    v.MaxBytes("encrypted", req.Encrypted, vincaConfig.Limits.ContentLimit())
+    return v.Err()
+}
+
+// Registration data, login requests decode the same struct but only
+// carry the email and password.
+func (p *UserParam) ValidateRegistration() error {
+    var v = Validation{}
+    v.Check(RgxUsernameCheck.MatchString(p.Username), "username", "invalid", "must be 1 to 16 letters")
+    v.Check(RgxEmailCheck.MatchString(p.Email), "email", "invalid", "must be a valid email address")
+    v.Password("password", p.Password, p.Username, p.Email)
+    return v.Err()
+}
+
+func (req *UserUpdateRequest) Validate() error {
+    var v = Validation{}
+    v.Required("confirmation", req.Confirmation)
+    v.Check(RgxEmailCheck.MatchString(req.Email), "email", "invalid", "must be a valid email address")
+    if req.Password != "" {
+        v.Password("password", req.Password, req.Username, req.Email)
+    }
+    return v.Err()
+}
+
+// The password policy needs the user of the token, see ValidatePassword.
+func (req *ResetConfirmRequest) Validate() error {
+    var v = Validation{}
+    v.Required("token", req.Token)
+    v.Required("password", req.Password)
+    return v.Err()
+}
+
+func (req *ResetConfirmRequest) ValidatePassword(usr *User) error {
+    var v = Validation{}
+    v.Password("password", req.Password, usr.Username, usr.Email)
+    return v.Err()
+}
+
+func (c *Container) Validate() error {
+    var v = Validation{}
+    v.MaxLength("name", c.Name, MaxNameLength)
+    v.MaxBytes("certificate", c.Certificate, vincaConfig.Limits.ContentLimit())
+    v.MaxBytes("encrypted", c.Encrypted, vincaConfig.Limits.ContentLimit())
+    return v.Err()
+}
+
+func (req *ContainerRotateRequest) Validate() error {
+    var v = Validation{}
+    var limit = vincaConfig.Limits.ContentLimit()
+    v.Check(req.Id > 0, "id", "required", "must reference a container")
+    v.MaxBytes("certificate", req.Certificate, limit)
+    v.MaxBytes("encrypted", req.Encrypted, limit)
+    for i, st := range req.Stores {
+        v.MaxBytes(ElementField("stores", i, "content"), st.Content, limit)
+    }
+    for i, member := range req.Members {
+        v.MaxBytes(ElementField("members", i, "encrypted"), member.Encrypted, limit)
+    }
+    return v.Err()
+}
+
+func (req *MemberRequest) Validate() error {
+    var v = Validation{}
+    v.MaxBytes("encrypted", req.Encrypted, vincaConfig.Limits.ContentLimit())
+    return v.Err()
+}
+
+// Entries without name or content are reported as failed rows by the
+// import itself, only oversized entries reject the whole request.
+func (req *ImportCommitRequest) Validate() error {
+    var v = Validation{}
+    var limit = vincaConfig.Limits.ContentLimit()
+    for i, entry := range req.Entries {
+        v.MaxLength(ElementField("entries", i, "name"), entry.Name, MaxNameLength)
+        v.MaxLength(ElementField("entries", i, "category"), entry.Category, MaxNameLength)
+        v.MaxLength(ElementField("entries", i, "description"), entry.Description, MaxDescriptionLength)
+        v.MaxBytes(ElementField("entries", i, "content"), entry.Content, limit)
+    }
+    return v.Err()
+}
+
+func (export *VaultExport) Validate() error {
+    var v = Validation{}
+    var limit = vincaConfig.Limits.ContentLimit()
+    for i, container := range export.Containers {
+        v.MaxLength(ElementField("containers", i, "name"), container.Name, MaxNameLength)
+        v.MaxBytes(ElementField("containers", i, "certificate"), container.Certificate, limit)
+        v.MaxBytes(ElementField("containers", i, "encrypted"), container.Encrypted, limit)
+    }
+    for i, category := range export.Categories {
+        if category == nil {
+            v.Fail(fmt.Sprintf("categories[%d]", i), "required", "must not be null")
+            continue
+        }
+        v.MaxLength(ElementField("categories", i, "name"), category.Name, MaxNameLength)
+        v.MaxLength(ElementField("categories", i, "description"), category.Description, MaxDescriptionLength)
+    }
+    for i, st := range export.Stores {
+        v.MaxLength(ElementField("stores", i, "name"), st.Name, MaxNameLength)
+        v.MaxLength(ElementField("stores", i, "description"), st.Description, MaxDescriptionLength)
+        v.MaxBytes(ElementField("stores", i, "content"), st.Content, limit)
+    }
+    return v.Err()
+}
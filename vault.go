@@ -0,0 +1,172 @@
+package main
+
+import "context"
+import "log/slog"
+import "net/http"
+
+const VaultExportVersion = 1
+
+var ErrUnsupportedExport = NewHandlerErr("vault_export_unsupported", http.StatusBadRequest)
+var ErrInvalidExport = NewHandlerErr("vault_export_invalid", http.StatusBadRequest)
+
+// Backup of everything owned by a user. Store content and container keys
+// stay encrypted, the server never sees clear text.
+type VaultExport struct {
+    Version int `json:"version"`
+    Exported Datetime `json:"exported"`
+    Containers []Container `json:"containers"`
+    Categories []*Category `json:"categories"`
+    Stores []Store `json:"stores"`
+}
+
+// Only counts are answered, the imported objects are kept for the events
+// published after the import.
+type VaultImportResult struct {
+    Containers int `json:"containers"`
+    Categories int `json:"categories"`
+    Stores int `json:"stores"`
+    categories []Category
+    stores []Store
+}
+
+func (v *VincaDatabase) ExportVault(ctx context.Context, usr *User) (*VaultExport, error) {
+    now, err := v.Now(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    var export = &VaultExport{
+        Version: VaultExportVersion,
+        Exported: now,
+        Categories: []*Category{},
+        Stores: []Store{},
+    }
+
+    if export.Containers, err = v.FetchContainers(ctx, usr); err != nil {
+        return nil, err
+    }
+
+    rows, err := v.db.Query("select id, name, description, icon, version from categories where user_id = ? order by id asc", usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to export categories", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var category = &Category{}
+        if err = rows.Scan(&category.Id, &category.Name, &category.Description, &category.Icon, &category.Version); err != nil {
+            slog.ErrorContext(ctx, "unable to scan exported category", "err", err)
+            return nil, err
+        }
+        export.Categories = append(export.Categories, category)
+    }
+
+    rows, err = v.db.Query("select id, container_id, category_id, created, last_used, modified, name, description, icon, color, version, content from stores where user_id = ? and deleted_at is null order by id asc", usr.Id)
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to export stores", "err", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var st = Store{}
+        err = rows.Scan(&st.Id, &st.Container, &st.Category,
+                        &st.Created, &st.LastUsed, &st.Modified,
+                        &st.Name, &st.Description, &st.Icon, &st.Color, &st.Version, &st.Content)
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to scan exported store", "err", err)
+            return nil, err
+        }
+        export.Stores = append(export.Stores, st)
+    }
+    return export, nil
+}
+
+// Recreates the exported data as new rows of the user. Container and
+// category ids are remapped, nothing is written when any row fails.
+func (v *VincaDatabase) ImportVault(ctx context.Context, usr *User, export *VaultExport) (*VaultImportResult, error) {
+    if export.Version != VaultExportVersion {
+        return nil, ErrUnsupportedExport
+    }
+
+    tx, err := v.db.Begin()
+    if err != nil {
+        slog.ErrorContext(ctx, "unable to begin vault import", "err", err)
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    var result = &VaultImportResult{}
+    var containers = make(map[int]int)
+    for _, container := range export.Containers {
+        res, err := tx.Exec("insert into containers(user_id, name, public, encrypted) values(?,?,?,?)",
+                usr.Id, container.Name, container.Certificate, container.Encrypted)
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to import container", "err", err)
+            return nil, err
+        }
+
+        cid, err := res.LastInsertId()
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to fetch imported container id", "err", err)
+            return nil, err
+        }
+        containers[container.Id] = int(cid)
+        result.Containers++
+    }
+
+    var categories = map[int]int{0: 0}
+    for _, category := range export.Categories {
+        res, err := tx.Exec("insert into categories(user_id, name, description, icon, version) values(?,?,?,?,1)",
+                usr.Id, category.Name, category.Description, category.Icon)
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to import category", "err", err)
+            return nil, err
+        }
+
+        cid, err := res.LastInsertId()
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to fetch imported category id", "err", err)
+            return nil, err
+        }
+        categories[category.Id] = int(cid)
+        result.categories = append(result.categories, Category{Id: int(cid), Version: 1})
+        result.Categories++
+    }
+
+    for _, st := range export.Stores {
+        container, ok := containers[st.Container]
+        if !ok {
+            slog.WarnContext(ctx, "imported store references unknown container", "store", st.Id, "container", st.Container)
+            return nil, ErrInvalidExport
+        }
+
+        category, ok := categories[st.Category]
+        if !ok {
+            slog.WarnContext(ctx, "imported store references unknown category", "store", st.Id, "category", st.Category)
+            return nil, ErrInvalidExport
+        }
+
+        res, err := tx.Exec("insert into stores(user_id, container_id, category_id, name, description, icon, color, content, version) values(?,?,?,?,?,?,?,?,1)",
+                usr.Id, container, category, st.Name, st.Description, st.Icon, st.Color, st.Content)
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to import store", "err", err)
+            return nil, err
+        }
+
+        sid, err := res.LastInsertId()
+        if err != nil {
+            slog.ErrorContext(ctx, "unable to fetch imported store id", "err", err)
+            return nil, err
+        }
+        result.stores = append(result.stores, Store{Id: int(sid), Version: 1, StoreParam: StoreParam{Container: container}})
+        result.Stores++
+    }
+
+    if err = tx.Commit(); err != nil {
+        slog.ErrorContext(ctx, "unable to commit vault import", "err", err)
+        return nil, err
+    }
+    return result, nil
+}
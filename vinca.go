@@ -1,28 +1,69 @@
 package main
 
-import "log"
+import "os"
+import "log/slog"
+import "flag"
 import "net/http"
 
 var vincaConfig = VincaConfig{}
 
-var vincaDatabase = VincaDatabase{}
+var vincaRepository Repository
 
-var vincaSessions = make(SessionContainer)
+var vincaSessions SessionContainer
 
 var vincaMux = &VincaMux{Cors: true}
 
+var vincaNotifier Notifier = LogNotifier{}
+
+var vincaLoginGuard *LoginGuard
+
+var vincaPasswordPolicy = DefaultPasswordPolicy()
+
 func main() {
+    migrate := flag.String("migrate", "", "run schema migrations (up, down or status) and exit")
+    flag.Parse()
+
     if vincaConfig.LoadConfig("config.json") != nil {
         return
     }
+    SetupLogging(vincaConfig.Log)
+
+    var database = &VincaDatabase{}
+    if *migrate != "" {
+        if err := database.OpenWith(vincaConfig.Driver, vincaConfig.Database); err != nil {
+            slog.Error("unable to open database connection", "err", err)
+            os.Exit(1)
+        }
+
+        err := database.RunMigrateCommand(*migrate)
+        database.Close()
+        if err != nil {
+            slog.Error("migration failed", "err", err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    policy, err := NewPasswordPolicy(vincaConfig.Passwords)
+    if err != nil {
+        slog.Error("unable to load password policy", "err", err)
+        os.Exit(1)
+    }
+    vincaPasswordPolicy = policy
 
-    if !vincaDatabase.Open() {
-        log.Println("unable to open database connection")
+    if !database.Open() {
+        slog.Error("unable to open database connection")
         return
     }
+    vincaRepository = database
+    vincaSessions = NewSessionContainer(vincaConfig.Sessions, database)
+    vincaNotifier = NewNotifier(vincaConfig.Notifier)
+    vincaLoginGuard = NewLoginGuard(vincaConfig.Lockout)
+    StartTrashPurge(vincaConfig.TrashLifetime())
 
-    log.Println("Starting vinca server..")
+    slog.Info("starting vinca server", "addr", ":3000")
     if err := http.ListenAndServe(":3000", vincaMux); err != nil {
-        log.Fatal(err)
+        slog.Error("server stopped", "err", err)
+        os.Exit(1)
     }
 }
\ No newline at end of file